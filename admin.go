@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Number of membership events kept in memory for /v1/events
+const MAX_EVENTS = 256
+
+//A change to the membership list as seen by the local VM
+type event struct {
+	Time        string `json:"time"`
+	Host        string `json:"host"`
+	Type        string `json:"type"`
+	Incarnation int    `json:"incarnation"`
+	By          string `json:"by,omitempty"`
+}
+
+//Member as reported by the admin API
+type memberInfo struct {
+	Host        string            `json:"host"`
+	State       string            `json:"state"`
+	TimeStamp   string            `json:"timestamp"`
+	RTT         string            `json:"rtt,omitempty"`
+	Coordinate  *coordinate       `json:"coordinate,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Incarnation int               `json:"incarnation"`
+	MinVersion  int               `json:"min_version"`
+	MaxVersion  int               `json:"max_version"`
+}
+
+//Estimated round trip time between two members as reported by the admin API
+type rttInfo struct {
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	RTT     string  `json:"rtt"`
+	Seconds float64 `json:"seconds"`
+}
+
+//Identity and configuration of the local VM as reported by the admin API
+type selfInfo struct {
+	Host        string `json:"host"`
+	Incarnation int    `json:"incarnation"`
+	Introducer  string `json:"introducer"`
+	Connected   bool   `json:"connected"`
+	//Protocol version the group operates at, as seen from the local membership list
+	ProtocolVersion int    `json:"protocol_version"`
+	Config          config `json:"config"`
+}
+
+//Ring buffer of recent events, oldest first once full
+var events = make([]event, 0, MAX_EVENTS)
+
+//Channels of clients following events as they happen
+var eventSubscribers = make(map[chan event]bool)
+
+//Mutex used for events and eventSubscribers
+var eventMutex = &sync.Mutex{}
+
+//HTTP server for /metrics and the admin API, shut down when the node stops
+var adminServer *http.Server
+
+var errIsIntroducer = errors.New("the introducer is always part of the group")
+var errAlreadyConnected = errors.New("already connected to a group")
+var errNotConnected = errors.New("not connected to a group")
+var errUnknownMember = errors.New("host is not in the membership list")
+var errRemoveSelf = errors.New("cannot remove the local VM, leave the group instead")
+var errNotRemoved = errors.New("host was not removed, its entry in the membership list is as recent as the removal, try again")
+var errNoCoordinate = errors.New("no coordinate known for the host")
+
+//Appends an event to the journal and adds it to the ring buffer, dropping the oldest one if it is full.
+//Events that are not a transition of the member are dropped. by is the VM that reported the event.
+//Writes to the journal file, so it must not be called from updateState
+func recordEvent(host string, eventType string, incarnation int, by string) {
+	e := event{time.Now().Format(time.RFC3339), host, eventType, incarnation, by}
+	if !journalEvent(e) {
+		return
+	}
+	eventMutex.Lock()
+	if len(events) == MAX_EVENTS {
+		events = append(events[:0], events[1:]...)
+	}
+	events = append(events, e)
+	for ch := range eventSubscribers {
+		//Never block the protocol on a slow subscriber
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	eventMutex.Unlock()
+}
+
+//Returns a channel receiving every new event and a function to stop the subscription
+func subscribeEvents() (chan event, func()) {
+	ch := make(chan event, 64)
+	eventMutex.Lock()
+	eventSubscribers[ch] = true
+	eventMutex.Unlock()
+	return ch, func() {
+		eventMutex.Lock()
+		delete(eventSubscribers, ch)
+		eventMutex.Unlock()
+	}
+}
+
+//Returns up to the n most recent events, oldest first
+func recentEvents(n int) []event {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	if n < 0 || n > len(events) {
+		n = len(events)
+	}
+	ret := make([]event, n)
+	copy(ret, events[len(events)-n:])
+	return ret
+}
+
+//Returns every member of the local membership list along with its estimated RTT and coordinate
+func getMembers() []memberInfo {
+	coords := getCoordinates()
+	list := snapshot().Members
+	members := make([]memberInfo, 0, len(list))
+	for _, element := range list {
+		info := memberInfo{Host: element.Host, State: "alive", TimeStamp: element.TimeStamp, Tags: element.Tags, Incarnation: element.Incarnation}
+		info.MinVersion, info.MaxVersion = versionRange(element.MinVersion, element.MaxVersion)
+		if c, ok := coords[element.Host]; ok {
+			info.Coordinate = &c
+			if element.Host != currHost {
+				info.RTT = coords[currHost].distanceTo(c).String()
+			}
+		}
+		members = append(members, info)
+	}
+	return members
+}
+
+//Returns the estimated RTT between members a and b. An empty b is the local VM
+func getRTT(a string, b string) (rttInfo, error) {
+	if b == "" {
+		b = currHost
+	}
+	rtt, ok := estimateRTT(a, b)
+	if !ok {
+		return rttInfo{}, errNoCoordinate
+	}
+	return rttInfo{a, b, rtt.String(), rtt.Seconds()}, nil
+}
+
+//Returns up to n members (all if n < 0) sorted by estimated RTT to host, closest first. An empty host is
+//the local VM
+func getNearest(host string, n int) ([]rttInfo, error) {
+	if host == "" {
+		host = currHost
+	}
+	if _, ok := estimateRTT(host, host); !ok {
+		return nil, errNoCoordinate
+	}
+	nearest := make([]rttInfo, 0)
+	for _, other := range nearestMembers(host, n) {
+		if info, err := getRTT(host, other); err == nil {
+			nearest = append(nearest, info)
+		}
+	}
+	return nearest, nil
+}
+
+//Returns the identity and configuration of the local VM
+func getSelf() selfInfo {
+	s := snapshot()
+	return selfInfo{
+		Host:            currHost,
+		Incarnation:     s.Incarnation,
+		Introducer:      conf().Introducer,
+		Connected:       currHost == conf().Introducer || s.Connected,
+		ProtocolVersion: groupVersion(s.Members),
+		Config:          conf(),
+	}
+}
+
+//Held for the whole of a join, so a join requested while another one is in progress (e.g. swimctl join
+//during an automatic rejoin) waits for its outcome
+var joiningMutex = &sync.Mutex{}
+
+//Sends a join request to each of the seeds. A seed other than the introducer forwards it to the introducer,
+//which answers with the membershipList
+func joinGroup(seeds []string) error {
+	if currHost == conf().Introducer {
+		return errIsIntroducer
+	}
+	joiningMutex.Lock()
+	defer joiningMutex.Unlock()
+	if snapshot().Connected {
+		return errAlreadyConnected
+	}
+	membershipLog.Info("Joining group", slog.Any("seeds", seeds))
+	setConnected(true)
+	if err := awaitJoin(seeds); err != nil {
+		setConnected(false)
+		membershipLog.Error("Join failed", slog.String("error", err.Error()))
+		return err
+	}
+	recordEvent(currHost, "joined", snapshot().Incarnation, currHost)
+	return nil
+}
+
+//Sends Adios to the group and waits for it to be acknowledged, then stops probing and clears the
+//membershipList so the VM can join again later. Returns true if the departure was acknowledged
+func leave() (bool, error) {
+	s := snapshot()
+	if !s.Connected {
+		return false, errNotConnected
+	}
+	confirmed := leaveGroup()
+	membershipLog.Info("Left group", slog.Bool("confirmed", confirmed), incarnationAttr(s.Incarnation))
+	recordEvent(currHost, "left", s.Incarnation, currHost)
+	resetMembership()
+	return confirmed, nil
+}
+
+//Forcefully marks host as failed and propagates the failure to the rest of the group. Returns
+//errNotRemoved, and propagates nothing, if the entry of host is not older than the Failed message
+//(timestamps only have a one second resolution, so e.g. a member that joined this second)
+func removeMember(host string) error {
+	if host == currHost {
+		return errRemoveSelf
+	}
+	s := snapshot()
+	if i := s.indexOf(host); i != -1 {
+		element := s.Members[i]
+		membershipLog.Info("Force removing member", peerAttr(host), incarnationAttr(element.Incarnation))
+		msg := newMsg(host, "Failed")
+		msg.Incarnation = element.Incarnation
+		if !propagateMsg(msg) {
+			return errNotRemoved
+		}
+		return nil
+	}
+	return errUnknownMember
+}
+
+//Helper function to write v as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	errorCheck(err)
+}
+
+//Helper function to write an error as the JSON body of a response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+//Returns false and writes a 405 if the request does not use the given method
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	return true
+}
+
+//GET /v1/members lists the membership list. DELETE /v1/members?host=<host> force removes a member
+func membersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, getMembers())
+	case http.MethodDelete:
+		host := r.URL.Query().Get("host")
+		switch err := removeMember(host); err {
+		case nil:
+		case errUnknownMember:
+			writeError(w, http.StatusNotFound, err)
+			return
+		case errNotRemoved:
+			writeError(w, http.StatusConflict, err)
+			return
+		default:
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, getMembers())
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+//GET /v1/self shows the identity and configuration of the local VM
+func selfHandler(w http.ResponseWriter, r *http.Request) {
+	if checkMethod(w, r, http.MethodGet) {
+		writeJSON(w, http.StatusOK, getSelf())
+	}
+}
+
+//POST /v1/join joins the group through the seeds in the body, {"seeds": [...]}, or the
+//configured seeds if none are given
+func joinHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	var body struct {
+		Seeds []string `json:"seeds"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if len(body.Seeds) == 0 {
+		body.Seeds = conf().joinSeeds()
+	}
+	if err := joinGroup(body.Seeds); err == errJoinTimeout {
+		writeError(w, http.StatusGatewayTimeout, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, getSelf())
+}
+
+//POST /v1/leave leaves the group. The node keeps running and can join again
+func leaveHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	confirmed, err := leave()
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"confirmed": confirmed})
+}
+
+//GET /v1/rtt?a=<host>&b=<host> estimates the RTT between two members from their coordinates. b defaults to
+//the local VM
+func rttHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	values := r.URL.Query()
+	if values.Get("a") == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing host a"))
+		return
+	}
+	info, err := getRTT(values.Get("a"), values.Get("b"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+//GET /v1/nearest?host=<host>&n=<count> lists up to n members sorted by estimated RTT to host, closest first.
+//host defaults to the local VM and n to every member
+func nearestHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	values := r.URL.Query()
+	n := -1
+	if value := values.Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	nearest, err := getNearest(values.Get("host"), n)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nearest)
+}
+
+//GET /v1/events?n=<count> returns the most recent membership events, oldest first
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	n := -1
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, recentEvents(n))
+}
+
+//GET /v1/logs?pattern=<regexp>&level=<level>&since=<time>&until=<time> searches the log of every member.
+//Matching lines and a final record per member are streamed back as one JSON object per line
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	values := r.URL.Query()
+	q := logQuery{Pattern: values.Get("pattern"), Level: values.Get("level"), Since: values.Get("since"), Until: values.Get("until")}
+	if _, err := q.compile(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	queryLogs(q, func(result logResult) {
+		encoder.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
+
+//GET /v1/journal?host=<host>&state=<alive|failed|left>&since=<time>&until=<time> returns the journaled
+//membership transitions, oldest first
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	values := r.URL.Query()
+	entries, err := queryJournal(journalQuery{values.Get("host"), values.Get("state"), values.Get("since"), values.Get("until")})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+//GET /v1/faults shows the faults injected by this VM. PUT /v1/faults replaces them with the body,
+//an empty body ({}) clears them
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, getFaults())
+	case http.MethodPut:
+		var fc faultConfig
+		if err := json.NewDecoder(r.Body).Decode(&fc); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := setFaults(fc); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, getFaults())
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+//POST /v1/reload reloads the config and reports which settings were applied and which require a restart
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+	result, err := reloadConfig()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+//GET /v1/recovery reports how the introducer started: whether it recovered the group from its saved state
+//and which members were confirmed, dropped or unreachable
+func recoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, getRecovery())
+}
+
+//Starts the local HTTP server used for /metrics and the admin API
+func httpServer() {
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/v1/members", membersHandler)
+	http.HandleFunc("/v1/self", selfHandler)
+	http.HandleFunc("/v1/rtt", rttHandler)
+	http.HandleFunc("/v1/nearest", nearestHandler)
+	http.HandleFunc("/v1/join", joinHandler)
+	http.HandleFunc("/v1/leave", leaveHandler)
+	http.HandleFunc("/v1/events", eventsHandler)
+	http.HandleFunc("/v1/reload", reloadHandler)
+	http.HandleFunc("/v1/logs", logsHandler)
+	http.HandleFunc("/v1/journal", journalHandler)
+	http.HandleFunc("/v1/faults", faultsHandler)
+	http.HandleFunc("/v1/recovery", recoveryHandler)
+	server := &http.Server{Addr: conf().HTTPAddr}
+	serversMutex.Lock()
+	adminServer = server
+	serversMutex.Unlock()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		errorCheck(err)
+	}
+}
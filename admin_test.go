@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//Sends DELETE /v1/members?host=host to membersHandler and returns the status code
+func deleteMember(host string) int {
+	w := httptest.NewRecorder()
+	membersHandler(w, httptest.NewRequest(http.MethodDelete, "/v1/members?host="+host, nil))
+	return w.Code
+}
+
+func TestRemoveMemberHandler(t *testing.T) {
+	setMembers(t, 2, 3)
+
+	if code := deleteMember(testHost(2)); code != http.StatusOK {
+		t.Fatalf("removing a member answered %d", code)
+	}
+	if snapshot().contains(testHost(2)) {
+		t.Fatal("member still in the membership list after it was removed")
+	}
+	if code := deleteMember(testHost(2)); code != http.StatusNotFound {
+		t.Fatalf("removing a member that is not in the membership list answered %d", code)
+	}
+	if code := deleteMember(currHost); code != http.StatusBadRequest {
+		t.Fatalf("removing the local VM answered %d", code)
+	}
+}
+
+//A member whose entry is not older than the removal (e.g. it joined this second) is not removed and the
+//request fails instead of reporting success
+func TestRemoveMemberNotRemoved(t *testing.T) {
+	setMembers(t, 2, 3)
+	updateState(func(s *groupState) bool {
+		s.Members[s.indexOf(testHost(3))].TimeStamp = time.Now().Add(time.Hour).Format(time.RFC850)
+		return true
+	})
+
+	if code := deleteMember(testHost(3)); code != http.StatusConflict {
+		t.Fatalf("removal that did not change the membership list answered %d", code)
+	}
+	if !snapshot().contains(testHost(3)) {
+		t.Fatal("member removed")
+	}
+	if len(lastStates()) > 0 {
+		t.Fatalf("removal that did not happen was journaled: %v", lastStates())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+//Cluster of VM's that do not set cluster_name, and of older builds that send no cluster name at all
+const DEFAULT_CLUSTER = "default"
+
+//Membership list as sent to the list port from protocol version 2 on, tagged with the cluster it belongs to
+type memberList struct {
+	Version int
+	Cluster string
+	Members []member
+}
+
+//Messages and membership lists dropped because they belong to another cluster, by type
+var foreignMsgs = newCounterVec()
+
+//Receives the outcome of a join in progress: nil once a membership list arrives, an error if a seed
+//belongs to another cluster. nil when no join is in progress
+var joinReply chan error
+
+//Mutex used for joinReply
+var joinMutex = &sync.Mutex{}
+
+var errJoinTimeout = errors.New("no membership list from the seeds within join_timeout")
+
+//Returns true if a message or membership list from src belongs to our cluster. Anything else is counted
+//and dropped. A Joining from another cluster is answered with ClusterMismatch so the join fails clearly
+func fromOurCluster(cluster string, status string, host string, src net.IP) bool {
+	if cluster == "" {
+		cluster = DEFAULT_CLUSTER
+	}
+	if cluster == conf().ClusterName {
+		return true
+	}
+	foreignMsgs.inc(status)
+	netLog.Warn("Dropped message from another cluster", typeAttr(status), peerAttr(host), slog.String("cluster", cluster), slog.String("from", src.String()))
+	if status == "Joining" && host != "" {
+		sendMsg(newMsg(currHost, "ClusterMismatch"), []string{host})
+	}
+	return false
+}
+
+//Called when a seed answers our Joining with ClusterMismatch
+func clusterMismatch(msg message) {
+	signalJoin(fmt.Errorf("seed %s belongs to cluster %q, this node to %q", msg.Host, msg.Cluster, conf().ClusterName))
+}
+
+//Reports the outcome of the join in progress, if any
+func signalJoin(err error) {
+	joinMutex.Lock()
+	defer joinMutex.Unlock()
+	if joinReply == nil {
+		return
+	}
+	select {
+	case joinReply <- err:
+	default:
+	}
+}
+
+//Sends Joining to the seeds and waits for the first membership list, a ClusterMismatch or join_timeout
+func awaitJoin(seeds []string) error {
+	reply := make(chan error, 1)
+	joinMutex.Lock()
+	joinReply = reply
+	joinMutex.Unlock()
+	defer func() {
+		joinMutex.Lock()
+		joinReply = nil
+		joinMutex.Unlock()
+	}()
+
+	connectToSeeds(seeds)
+	select {
+	case err := <-reply:
+		return err
+	case <-time.After(conf().JoinTimeout.Duration):
+		return errJoinTimeout
+	}
+}
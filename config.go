@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Prefix of the environment variables overriding the config file, e.g. SWIM_INTRODUCER
+const ENV_PREFIX = "SWIM_"
+
+//A time.Duration that is written as "2.5s" in the config file instead of nanoseconds
+type duration struct {
+	time.Duration
+}
+
+//Settings of the node. Values come from the defaults, then the config file, then environment
+//variables and finally command line flags, each overriding the previous one
+type config struct {
+	//Name of the group this VM belongs to. Traffic from VM's with another cluster_name is dropped, so
+	//independent groups can share a network
+	ClusterName string `json:"cluster_name"`
+	//IP address, as a string, for the introducer - the VM that other VM's will ping to join the group
+	Introducer string `json:"introducer"`
+	//Members to send join requests to. Defaults to just the introducer
+	Seeds []string `json:"seeds"`
+	//Time a join waits for the membershipList from the seeds before failing
+	JoinTimeout duration `json:"join_timeout"`
+	//Rejoin the group through the last known peers after restarting, if the VM was a member when it stopped
+	AutoRejoin bool `json:"auto_rejoin"`
+	//Address other VM's use to reach this one, in CIDR form. Defaults to the address of the first interface
+	AdvertiseAddr string `json:"advertise_addr"`
+	//IP the UDP servers and the log query server listen on. Defaults to the IP of advertise_addr, 0.0.0.0
+	//listens on every interface
+	BindAddr string `json:"bind_addr"`
+	//UDP ports for messages and membershipList updates. Must be the same on every VM
+	MessagePort int `json:"message_port"`
+	ListPort    int `json:"list_port"`
+	//TCP port other members send log queries to and how long a query waits for a member to answer.
+	//The port must be the same on every VM
+	QueryPort    int      `json:"query_port"`
+	QueryTimeout duration `json:"query_timeout"`
+	//Local address for the HTTP server exporting /metrics and the admin API
+	HTTPAddr string `json:"http_addr"`
+	//Path of the Unix domain socket swimctl uses to talk to the node. Relative paths are inside data_dir
+	ControlSocket string `json:"control_socket"`
+
+	//Range of protocol versions this VM speaks, see version.go. Lower protocol_max to keep a new build
+	//speaking an older version
+	ProtocolMin int `json:"protocol_min"`
+	ProtocolMax int `json:"protocol_max"`
+
+	//Minimum number of VM's in the group before Syn/Ack-ing begins
+	MinHosts int `json:"min_hosts"`
+	//Number of successors each VM monitors, of predecessors a leaving VM waits for and of members a failure
+	//is propagated to. The group detects up to fanout simultaneous failures, see Failure detection in the readme
+	Fanout int `json:"fanout"`
+	//Time between two rounds of SYN's
+	ProbeInterval duration `json:"probe_interval"`
+	//Maximum time a VM will wait for an ACK from a machine before marking it as failed
+	AckTimeout duration `json:"ack_timeout"`
+	//Packet loss, latency and partitions injected for testing, see faults.go
+	Faults faultConfig `json:"faults"`
+
+	//How often recently failed members and missing seeds are sent our membershipList (0 disables) and for how
+	//long failed members are contacted, so the group can merge again after a partition heals
+	ReconnectInterval duration `json:"reconnect_interval"`
+	ReconnectTimeout  duration `json:"reconnect_timeout"`
+
+	//Whether a restarted introducer rebuilds the group from its saved state: always, never or ask (only
+	//with the interactive menu, -daemon recovers)
+	RecoveryPolicy string `json:"recovery_policy"`
+	//isAlive messages sent to each member when the introducer restarts, how long it waits for an answer
+	//before sending the next one and how long the whole check may take
+	IsAliveCount    int      `json:"is_alive_count"`
+	IsAliveInterval duration `json:"is_alive_interval"`
+	RecoveryWait    duration `json:"recovery_wait"`
+
+	//How long a leaving VM waits for its Adios to be acknowledged and how often it is resent
+	LeaveTimeout       duration `json:"leave_timeout"`
+	LeaveRetryInterval duration `json:"leave_retry_interval"`
+
+	//Directory every VM saves its member table in, see persist.go
+	DataDir string `json:"data_dir"`
+	//membershipList file written by the introducer of older builds. Imported into data_dir once
+	MembershipFile string `json:"membership_file"`
+	//File every membership transition is appended to, empty to disable the journal. Relative paths are inside data_dir
+	JournalFile string `json:"journal_file"`
+	//Log file path ("-" for stdout), format (text or json) and level (debug, info, warn or error).
+	//log_levels overrides the level per subsystem, e.g. {"probe": "debug"}. A relative log file is inside data_dir
+	LogFile   string            `json:"log_file"`
+	LogFormat string            `json:"log_format"`
+	LogLevel  string            `json:"log_level"`
+	LogLevels map[string]string `json:"log_levels"`
+	//Rotate log_file once it is larger than log_max_size megabytes or older than log_max_age (0 disables either),
+	//keep the newest log_max_backups rotated files (0 keeps all) and gzip them if log_compress is set
+	LogMaxSize    int      `json:"log_max_size"`
+	LogMaxAge     duration `json:"log_max_age"`
+	LogMaxBackups int      `json:"log_max_backups"`
+	LogCompress   bool     `json:"log_compress"`
+
+	//Metadata announced to the group when joining, e.g. {"zone": "a"}
+	Tags map[string]string `json:"tags"`
+}
+
+//Binding between a config field and its flag and environment variable
+type setting struct {
+	name  string
+	usage string
+	set   func(c *config, value string) error
+}
+
+//Effective configuration of the node. Only read through conf() once the node is running
+var cfg = defaultConfig()
+
+//Mutex used for cfg, which can be replaced by a reload
+var cfgMutex = &sync.RWMutex{}
+
+//Path of the config file, only set with a flag or SWIM_CONFIG
+var configPath = flag.String("config", "", "Path of a JSON config file")
+
+//Prints the effective config and exits
+var printConfig = flag.Bool("print-config", false, "Print the effective config as JSON and exit")
+
+var settings = []setting{
+	{"cluster-name", "Name of the group, traffic from other clusters is dropped", func(c *config, v string) error { c.ClusterName = v; return nil }},
+	{"introducer", "Address of the introducer in CIDR form", func(c *config, v string) error { c.Introducer = v; return nil }},
+	{"seeds", "Comma separated members to join through", func(c *config, v string) error { c.Seeds = splitList(v); return nil }},
+	{"join-timeout", "Time a join waits for the membership list from the seeds", func(c *config, v string) error { return setDuration(&c.JoinTimeout, v) }},
+	{"auto-rejoin", "Rejoin the group through the last known peers after a restart", func(c *config, v string) error { return setBool(&c.AutoRejoin, v) }},
+	{"advertise-addr", "Address other VM's use to reach this one, in CIDR form", func(c *config, v string) error { c.AdvertiseAddr = v; return nil }},
+	{"bind-addr", "IP the UDP servers and the log query server listen on, default the advertise address", func(c *config, v string) error { c.BindAddr = v; return nil }},
+	{"message-port", "UDP port for messages", func(c *config, v string) error { return setInt(&c.MessagePort, v) }},
+	{"list-port", "UDP port for membership list updates", func(c *config, v string) error { return setInt(&c.ListPort, v) }},
+	{"query-port", "TCP port for log queries from other members", func(c *config, v string) error { return setInt(&c.QueryPort, v) }},
+	{"query-timeout", "Time a log query waits for a member to answer", func(c *config, v string) error { return setDuration(&c.QueryTimeout, v) }},
+	{"http-addr", "Local address for /metrics and the admin API", func(c *config, v string) error { c.HTTPAddr = v; return nil }},
+	{"control-socket", "Path of the swimctl Unix domain socket", func(c *config, v string) error { c.ControlSocket = v; return nil }},
+	{"protocol-min", "Lowest protocol version spoken", func(c *config, v string) error { return setInt(&c.ProtocolMin, v) }},
+	{"protocol-max", "Highest protocol version spoken", func(c *config, v string) error { return setInt(&c.ProtocolMax, v) }},
+	{"min-hosts", "Minimum number of VM's before Syn/Ack-ing begins", func(c *config, v string) error { return setInt(&c.MinHosts, v) }},
+	{"fanout", "Number of successors each VM monitors", func(c *config, v string) error { return setInt(&c.Fanout, v) }},
+	{"probe-interval", "Time between two rounds of SYN's", func(c *config, v string) error { return setDuration(&c.ProbeInterval, v) }},
+	{"ack-timeout", "Time to wait for an ACK before marking a VM as failed", func(c *config, v string) error { return setDuration(&c.AckTimeout, v) }},
+	{"faults", "Faults to inject as JSON, e.g. {\"rules\": [{\"drop\": 10}]}", func(c *config, v string) error { return setFaultConfig(&c.Faults, v) }},
+	{"reconnect-interval", "Time between two rounds of reconnect probes to failed members, 0 to disable", func(c *config, v string) error { return setDuration(&c.ReconnectInterval, v) }},
+	{"reconnect-timeout", "How long failed members are sent reconnect probes", func(c *config, v string) error { return setDuration(&c.ReconnectTimeout, v) }},
+	{"recovery-policy", "Whether a restarted introducer recovers the saved group: always, never or ask", func(c *config, v string) error { c.RecoveryPolicy = v; return nil }},
+	{"is-alive-count", "isAlive messages sent to each member when the introducer restarts", func(c *config, v string) error { return setInt(&c.IsAliveCount, v) }},
+	{"is-alive-interval", "Time to wait for an answer before resending isAlive", func(c *config, v string) error { return setDuration(&c.IsAliveInterval, v) }},
+	{"recovery-wait", "Time the introducer spends checking which members are alive after restarting", func(c *config, v string) error { return setDuration(&c.RecoveryWait, v) }},
+	{"leave-timeout", "Time a leaving VM waits for its Adios to be acknowledged", func(c *config, v string) error { return setDuration(&c.LeaveTimeout, v) }},
+	{"leave-retry-interval", "Time between two Adios while leaving", func(c *config, v string) error { return setDuration(&c.LeaveRetryInterval, v) }},
+	{"data-dir", "Directory the member table is saved in", func(c *config, v string) error { c.DataDir = v; return nil }},
+	{"membership-file", "Membership list file of older introducers, imported into data-dir once", func(c *config, v string) error { c.MembershipFile = v; return nil }},
+	{"journal-file", "File membership transitions are journaled to, empty to disable", func(c *config, v string) error { c.JournalFile = v; return nil }},
+	{"log-file", "Path of the log file, - for stdout", func(c *config, v string) error { c.LogFile = v; return nil }},
+	{"log-format", "Log format, text or json", func(c *config, v string) error { c.LogFormat = v; return nil }},
+	{"log-level", "Log level, debug, info, warn or error", func(c *config, v string) error { c.LogLevel = v; return nil }},
+	{"log-levels", "Comma separated subsystem=level overrides, e.g. probe=debug,net=warn", func(c *config, v string) error { return setTags(&c.LogLevels, v) }},
+	{"log-max-size", "Rotate the log file once it is larger than this many megabytes, 0 to disable", func(c *config, v string) error { return setInt(&c.LogMaxSize, v) }},
+	{"log-max-age", "Rotate the log file once it is older than this, 0 to disable", func(c *config, v string) error { return setDuration(&c.LogMaxAge, v) }},
+	{"log-max-backups", "Number of rotated log files to keep, 0 keeps all", func(c *config, v string) error { return setInt(&c.LogMaxBackups, v) }},
+	{"log-compress", "Gzip rotated log files", func(c *config, v string) error { return setBool(&c.LogCompress, v) }},
+	{"tags", "Comma separated key=value metadata announced to the group", func(c *config, v string) error { return setTags(&c.Tags, v) }},
+}
+
+//Flag values, only applied if the flag was given on the command line
+var flagValues = make(map[string]*string)
+
+//Returns the configuration used when nothing is overridden
+func defaultConfig() config {
+	return config{
+		ClusterName:        DEFAULT_CLUSTER,
+		Introducer:         "172.22.149.18/23",
+		JoinTimeout:        duration{5 * time.Second},
+		AutoRejoin:         true,
+		MessagePort:        10000,
+		ListPort:           10001,
+		QueryPort:          10003,
+		QueryTimeout:       duration{5 * time.Second},
+		HTTPAddr:           "127.0.0.1:10002",
+		ControlSocket:      "swim.sock",
+		ProtocolMin:        PROTOCOL_VERSION_MIN,
+		ProtocolMax:        PROTOCOL_VERSION_MAX,
+		MinHosts:           2,
+		Fanout:             2,
+		ProbeInterval:      duration{1 * time.Second},
+		AckTimeout:         duration{2500 * time.Millisecond},
+		ReconnectInterval:  duration{5 * time.Second},
+		ReconnectTimeout:   duration{10 * time.Minute},
+		RecoveryPolicy:     "always",
+		IsAliveCount:       5,
+		IsAliveInterval:    duration{500 * time.Millisecond},
+		RecoveryWait:       duration{3 * time.Second},
+		LeaveTimeout:       duration{3 * time.Second},
+		LeaveRetryInterval: duration{500 * time.Millisecond},
+		DataDir:            "data",
+		MembershipFile:     "MList.txt",
+		JournalFile:        "journal.jsonl",
+		LogFile:            "logfile.log",
+		LogFormat:          "text",
+		LogLevel:           "info",
+		LogMaxSize:         100,
+		LogMaxBackups:      5,
+	}
+}
+
+//Returns the effective configuration. Safe to call from any goroutine
+func conf() config {
+	cfgMutex.RLock()
+	defer cfgMutex.RUnlock()
+	return cfg
+}
+
+//Registers a flag for every setting. Must be called before flag.Parse
+func registerConfigFlags() {
+	for _, s := range settings {
+		if boolSettings[s.name] {
+			value := new(string)
+			flag.Var(boolFlag{value}, s.name, s.usage)
+			flagValues[s.name] = value
+			continue
+		}
+		flagValues[s.name] = flag.String(s.name, "", s.usage)
+	}
+}
+
+//Settings given as a flag without a value (-log-compress rather than -log-compress=true)
+var boolSettings = map[string]bool{"auto-rejoin": true, "log-compress": true}
+
+type boolFlag struct {
+	value *string
+}
+
+func (b boolFlag) String() string {
+	if b.value == nil {
+		return ""
+	}
+	return *b.value
+}
+
+func (b boolFlag) Set(v string) error {
+	*b.value = v
+	return nil
+}
+
+func (b boolFlag) IsBoolFlag() bool { return true }
+
+//Builds the effective config from the defaults, the config file, the environment and the flags
+func loadConfig() (config, error) {
+	c := defaultConfig()
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv(ENV_PREFIX + "CONFIG")
+	}
+	if path != "" {
+		if err := readConfigFile(&c, path); err != nil {
+			return c, err
+		}
+	}
+
+	for _, s := range settings {
+		key := ENV_PREFIX + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+		if value, ok := os.LookupEnv(key); ok {
+			if err := s.set(&c, value); err != nil {
+				return c, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && err == nil {
+				if e := s.set(&c, *flagValues[s.name]); e != nil {
+					err = fmt.Errorf("-%s: %v", s.name, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	c.resolvePaths()
+	return c, c.validate()
+}
+
+//Makes relative log_file, journal_file and control_socket paths relative to data_dir, so two nodes with
+//their own data_dir, which is locked, never share them even when started in the same directory
+func (c *config) resolvePaths() {
+	for _, path := range []*string{&c.LogFile, &c.JournalFile, &c.ControlSocket} {
+		if *path != "" && *path != "-" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(c.DataDir, *path)
+		}
+	}
+}
+
+//Reads a JSON config file on top of c. Unknown keys are an error so typos don't go unnoticed
+func readConfigFile(c *config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+//Returns an error describing the first invalid setting
+func (c config) validate() error {
+	if c.ClusterName == "" {
+		return errors.New("cluster_name must be set")
+	}
+	if _, _, err := net.ParseCIDR(c.Introducer); err != nil {
+		return fmt.Errorf("introducer: %v", err)
+	}
+	for _, seed := range c.Seeds {
+		if _, _, err := net.ParseCIDR(seed); err != nil {
+			return fmt.Errorf("seeds: %v", err)
+		}
+	}
+	if c.AdvertiseAddr != "" {
+		if _, _, err := net.ParseCIDR(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("advertise_addr: %v", err)
+		}
+	}
+	if c.BindAddr != "" && net.ParseIP(c.BindAddr) == nil {
+		return errors.New("bind_addr: not an IP address: " + c.BindAddr)
+	}
+	if c.MessagePort < 1 || c.MessagePort > 65535 || c.ListPort < 1 || c.ListPort > 65535 {
+		return errors.New("message_port and list_port must be between 1 and 65535")
+	}
+	if c.MessagePort == c.ListPort {
+		return errors.New("message_port and list_port must be different")
+	}
+	if c.QueryPort < 1 || c.QueryPort > 65535 {
+		return errors.New("query_port must be between 1 and 65535")
+	}
+	if c.QueryTimeout.Duration <= 0 {
+		return errors.New("query_timeout must be positive")
+	}
+	if c.JoinTimeout.Duration <= 0 {
+		return errors.New("join_timeout must be positive")
+	}
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		return fmt.Errorf("http_addr: %v", err)
+	}
+	if c.ControlSocket == "" {
+		return errors.New("control_socket must be set")
+	}
+	if c.ProtocolMin < PROTOCOL_VERSION_MIN || c.ProtocolMax > PROTOCOL_VERSION_MAX || c.ProtocolMin > c.ProtocolMax {
+		return fmt.Errorf("protocol_min and protocol_max must be a range within %d-%d", PROTOCOL_VERSION_MIN, PROTOCOL_VERSION_MAX)
+	}
+	if c.MinHosts < 2 {
+		return errors.New("min_hosts must be at least 2")
+	}
+	if c.Fanout < 1 {
+		return errors.New("fanout must be at least 1")
+	}
+	if c.ProbeInterval.Duration <= 0 {
+		return errors.New("probe_interval must be positive")
+	}
+	if c.AckTimeout.Duration <= c.ProbeInterval.Duration {
+		return errors.New("ack_timeout must be longer than probe_interval")
+	}
+	if c.ReconnectInterval.Duration < 0 || c.ReconnectTimeout.Duration < 0 {
+		return errors.New("reconnect_interval and reconnect_timeout must not be negative")
+	}
+	if err := c.Faults.validate(); err != nil {
+		return err
+	}
+	if c.RecoveryPolicy != "always" && c.RecoveryPolicy != "never" && c.RecoveryPolicy != "ask" {
+		return errors.New("recovery_policy must be always, never or ask")
+	}
+	if c.IsAliveCount < 1 || c.IsAliveInterval.Duration <= 0 || c.RecoveryWait.Duration <= 0 {
+		return errors.New("is_alive_count, is_alive_interval and recovery_wait must be positive")
+	}
+	if c.LeaveRetryInterval.Duration <= 0 || c.LeaveTimeout.Duration < c.LeaveRetryInterval.Duration {
+		return errors.New("leave_retry_interval must be positive and leave_timeout at least as long")
+	}
+	if c.DataDir == "" || c.MembershipFile == "" || c.LogFile == "" {
+		return errors.New("data_dir, membership_file and log_file must be set")
+	}
+	if err := validateLogConfig(c); err != nil {
+		return err
+	}
+	for key := range c.Tags {
+		if key == "" || strings.ContainsAny(key, "=,") {
+			return errors.New("tags: invalid key " + strconv.Quote(key))
+		}
+	}
+	return nil
+}
+
+//Members to send join requests to
+func (c config) joinSeeds() []string {
+	if len(c.Seeds) == 0 {
+		return []string{c.Introducer}
+	}
+	return c.Seeds
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+//Accepts either a string such as "2.5s" or a number of nanoseconds
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		return setDuration(d, s)
+	}
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return errors.New("durations must be strings such as \"2.5s\"")
+	}
+	d.Duration = time.Duration(n)
+	return nil
+}
+
+func setInt(dst *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+func setBool(dst *bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
+
+func setDuration(dst *duration, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	dst.Duration = d
+	return nil
+}
+
+//Parses "key=value,key=value" into a map (tags and log_levels)
+func setTags(dst *map[string]string, value string) error {
+	tags := make(map[string]string)
+	for _, item := range splitList(value) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("expected key=value, got " + item)
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	*dst = tags
+	return nil
+}
+
+//Splits a comma separated list, ignoring empty entries
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+//Helper function to print the effective config as indented JSON
+func printEffectiveConfig() {
+	b, err := json.MarshalIndent(conf(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println(string(b))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+//Relative log, journal and control socket paths end up inside data_dir, so nodes with their own data_dir
+//never share them
+func TestPathsInsideDataDir(t *testing.T) {
+	c := defaultConfig()
+	c.DataDir = "node2"
+	c.resolvePaths()
+	for name, path := range map[string]string{"log_file": c.LogFile, "journal_file": c.JournalFile, "control_socket": c.ControlSocket} {
+		if filepath.Dir(path) != "node2" {
+			t.Errorf("%s is %s, want it inside data_dir", name, path)
+		}
+	}
+
+	c = defaultConfig()
+	c.LogFile = "-"
+	c.JournalFile = ""
+	c.ControlSocket = "/run/swim.sock"
+	c.resolvePaths()
+	if c.LogFile != "-" || c.JournalFile != "" || c.ControlSocket != "/run/swim.sock" {
+		t.Errorf("stdout, a disabled journal or an absolute path changed: %q %q %q", c.LogFile, c.JournalFile, c.ControlSocket)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+//Request sent by swimctl, one JSON object per connection
+type controlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Follow  bool     `json:"follow,omitempty"`
+	//Only used by grep
+	Query logQuery `json:"query,omitempty"`
+	//Only used by history
+	Journal journalQuery `json:"journal,omitempty"`
+}
+
+//Response sent back to swimctl. Commands that stream (events with follow, grep) send one response per line
+type controlResponse struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+var errUnknownCommand = errors.New("unknown command")
+
+//Listener for the control socket, closed when the node stops
+var controlListener net.Listener
+
+//Server listening on the control socket for swimctl commands
+func controlServer() {
+	//A socket left behind by a previous run would make Listen fail
+	if conn, err := net.Dial("unix", conf().ControlSocket); err == nil {
+		conn.Close()
+		errorCheck(errors.New("another node is already listening on " + conf().ControlSocket))
+		return
+	}
+	os.Remove(conf().ControlSocket)
+
+	listener, err := net.Listen("unix", conf().ControlSocket)
+	if err != nil {
+		errorCheck(err)
+		return
+	}
+	defer listener.Close()
+	serversMutex.Lock()
+	controlListener = listener
+	serversMutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isStopping() {
+				return
+			}
+			errorCheck(err)
+			continue
+		}
+		go handleControl(conn)
+	}
+}
+
+//Reads a single request from conn and writes the response(s)
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	var req controlRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		errorCheck(err)
+		return
+	}
+	encoder := json.NewEncoder(conn)
+
+	if req.Command == "events" && req.Follow {
+		followEvents(conn, encoder)
+		return
+	}
+
+	if req.Command == "grep" {
+		err := queryLogs(req.Query, func(r logResult) {
+			encoder.Encode(controlResponse{OK: true, Result: r})
+		})
+		if err != nil {
+			encoder.Encode(controlResponse{Error: err.Error()})
+		}
+		return
+	}
+
+	result, err := runControl(req)
+	if err != nil {
+		encoder.Encode(controlResponse{Error: err.Error()})
+		return
+	}
+	encoder.Encode(controlResponse{OK: true, Result: result})
+}
+
+//Runs a non-streaming command and returns its result
+func runControl(req controlRequest) (interface{}, error) {
+	switch req.Command {
+	case "members":
+		return getMembers(), nil
+	case "info":
+		return getSelf(), nil
+	case "config":
+		return conf(), nil
+	case "reload":
+		return reloadConfig()
+	case "stats":
+		return getStats(), nil
+	case "rtt":
+		if len(req.Args) == 0 || len(req.Args) > 2 {
+			return nil, errors.New("usage: rtt a [b]")
+		}
+		b := ""
+		if len(req.Args) == 2 {
+			b = req.Args[1]
+		}
+		return getRTT(req.Args[0], b)
+	case "nearest":
+		host, n := "", -1
+		if len(req.Args) > 0 {
+			host = req.Args[0]
+		}
+		if len(req.Args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(req.Args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return getNearest(host, n)
+	case "join":
+		seeds := req.Args
+		if len(seeds) == 0 {
+			seeds = conf().joinSeeds()
+		}
+		if err := joinGroup(seeds); err != nil {
+			return nil, err
+		}
+		return getSelf(), nil
+	case "leave":
+		confirmed, err := leave()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]bool{"confirmed": confirmed}, nil
+	case "events":
+		n := -1
+		if len(req.Args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(req.Args[0]); err != nil {
+				return nil, err
+			}
+		}
+		return recentEvents(n), nil
+	case "faults":
+		return faultsCommand(req.Args)
+	case "history":
+		return queryJournal(req.Journal)
+	case "recovery":
+		return getRecovery(), nil
+	}
+	return nil, errUnknownCommand
+}
+
+//Streams every new event to the client until it hangs up
+func followEvents(conn net.Conn, encoder *json.Encoder) {
+	ch, cancel := subscribeEvents()
+	defer cancel()
+
+	//Notice when the client goes away even if no events are happening
+	closed := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		conn.Read(buf)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case e := <-ch:
+			if err := encoder.Encode(controlResponse{OK: true, Result: e}); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
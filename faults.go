@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Faults injected into the messages and membership lists this VM sends and receives. Used to test
+//the protocol under packet loss, latency and partitions. Set with the faults setting, PUT /v1/faults
+//or swimctl faults
+type faultConfig struct {
+	//Seed of the random number generator deciding which messages are affected, 0 picks one from the clock.
+	//The same seed and traffic give the same faults
+	Seed int64 `json:"seed"`
+	//Applied to outgoing traffic. The first rule matching the peer and message type is used
+	Rules []faultRule `json:"rules"`
+	//Named sets of hosts used by partitions, e.g. {"east": ["172.22.149.18", "172.22.149.19"]}
+	Sets map[string][]string `json:"sets"`
+	//Traffic between the sets is dropped in both directions, or only from From to To if OneWay is set
+	Partitions []partition `json:"partitions"`
+}
+
+type faultRule struct {
+	//Hosts (with or without the /mask) and message types (SYN, ACK, Failed, MembershipList, ...) the rule
+	//applies to. Empty matches everything
+	Peers []string `json:"peers,omitempty"`
+	Types []string `json:"types,omitempty"`
+	//Percentages of messages dropped, sent twice and held back by reorder_delay so later ones overtake them
+	Drop      int `json:"drop,omitempty"`
+	Duplicate int `json:"duplicate,omitempty"`
+	Reorder   int `json:"reorder,omitempty"`
+	//Every message is delayed by delay plus or minus a random jitter
+	Delay        duration `json:"delay"`
+	Jitter       duration `json:"jitter"`
+	ReorderDelay duration `json:"reorder_delay"`
+}
+
+type partition struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	OneWay bool   `json:"one_way,omitempty"`
+}
+
+//Faults in effect and the random number generator they use
+var faults faultConfig
+var faultRand = rand.New(rand.NewSource(1))
+
+//Mutex used for faults and faultRand
+var faultMutex = &sync.Mutex{}
+
+//Checks percentages, durations and that partitions only use sets that exist
+func (fc faultConfig) validate() error {
+	for i, r := range fc.Rules {
+		for _, p := range []int{r.Drop, r.Duplicate, r.Reorder} {
+			if p < 0 || p > 100 {
+				return fmt.Errorf("faults: rule %d: drop, duplicate and reorder must be between 0 and 100", i)
+			}
+		}
+		if r.Delay.Duration < 0 || r.Jitter.Duration < 0 || r.ReorderDelay.Duration < 0 {
+			return fmt.Errorf("faults: rule %d: delay, jitter and reorder_delay must not be negative", i)
+		}
+		if r.Reorder > 0 && r.ReorderDelay.Duration == 0 {
+			return fmt.Errorf("faults: rule %d: reorder needs a reorder_delay", i)
+		}
+	}
+	for i, p := range fc.Partitions {
+		if _, ok := fc.Sets[p.From]; !ok {
+			return fmt.Errorf("faults: partition %d: unknown set %q", i, p.From)
+		}
+		if _, ok := fc.Sets[p.To]; !ok {
+			return fmt.Errorf("faults: partition %d: unknown set %q", i, p.To)
+		}
+	}
+	return nil
+}
+
+//Replaces the faults in effect and reseeds the random number generator
+func setFaults(fc faultConfig) error {
+	if err := fc.validate(); err != nil {
+		return err
+	}
+	seed := fc.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	faultMutex.Lock()
+	faults = fc
+	faultRand = rand.New(rand.NewSource(seed))
+	faultMutex.Unlock()
+	nodeLog.Info("Fault injection updated", slog.Int("rules", len(fc.Rules)), slog.Int("partitions", len(fc.Partitions)), slog.Int64("seed", seed))
+	return nil
+}
+
+func getFaults() faultConfig {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	return faults
+}
+
+//Parses the JSON form used by the faults flag and environment variable
+func setFaultConfig(dst *faultConfig, value string) error {
+	var fc faultConfig
+	if err := json.Unmarshal([]byte(value), &fc); err != nil {
+		return err
+	}
+	*dst = fc
+	return nil
+}
+
+//Returns the IP of a host given with or without the /mask
+func hostIP(host string) string {
+	return strings.SplitN(host, "/", 2)[0]
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if hostIP(h) == hostIP(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns true if a partition drops traffic from src to dst. Must be called while holding faultMutex
+func partitioned(src string, dst string) bool {
+	for _, p := range faults.Partitions {
+		from, to := faults.Sets[p.From], faults.Sets[p.To]
+		if containsHost(from, src) && containsHost(to, dst) {
+			return true
+		}
+		if !p.OneWay && containsHost(to, src) && containsHost(from, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns true if a message from src should be dropped because of a partition. Used by the servers
+//so a partition only set up on one side still cuts traffic in both directions
+func dropIncoming(src net.IP) bool {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	if partitioned(src.String(), currHost) {
+		netLog.Debug("Dropped message from a partitioned VM", peerAttr(src.String()))
+		return true
+	}
+	return false
+}
+
+//Sends a message of type status to host by calling send, unless the faults in effect drop it.
+//send may be called later (delay, reorder) or twice (duplicate)
+func injectFaults(host string, status string, send func()) {
+	faultMutex.Lock()
+	if partitioned(currHost, host) {
+		faultMutex.Unlock()
+		msgsDropped.inc(status)
+		netLog.Debug("Dropped message to a partitioned VM", typeAttr(status), peerAttr(host))
+		return
+	}
+
+	var rule *faultRule
+	for i, r := range faults.Rules {
+		if (len(r.Peers) == 0 || containsHost(r.Peers, host)) && (len(r.Types) == 0 || containsString(r.Types, status)) {
+			rule = &faults.Rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		faultMutex.Unlock()
+		send()
+		return
+	}
+
+	if faultRand.Intn(100) < rule.Drop {
+		faultMutex.Unlock()
+		msgsDropped.inc(status)
+		netLog.Debug("Dropped message", typeAttr(status), peerAttr(host))
+		return
+	}
+	copies := 1
+	if faultRand.Intn(100) < rule.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = rule.Delay.Duration
+		if rule.Jitter.Duration > 0 {
+			delays[i] += time.Duration(faultRand.Int63n(int64(2*rule.Jitter.Duration))) - rule.Jitter.Duration
+		}
+		if faultRand.Intn(100) < rule.Reorder {
+			delays[i] += rule.ReorderDelay.Duration
+		}
+	}
+	faultMutex.Unlock()
+
+	for _, delay := range delays {
+		if delay <= 0 {
+			send()
+		} else {
+			time.AfterFunc(delay, send)
+		}
+	}
+	if copies > 1 {
+		netLog.Debug("Duplicated message", typeAttr(status), peerAttr(host))
+	}
+}
+
+var errFaultArgs = errors.New("expected no arguments, set <json> or clear")
+
+//Runs the faults command of swimctl: show the faults in effect, replace them or clear them
+func faultsCommand(args []string) (faultConfig, error) {
+	switch {
+	case len(args) == 0:
+		return getFaults(), nil
+	case len(args) == 2 && args[0] == "set":
+		var fc faultConfig
+		if err := setFaultConfig(&fc, args[1]); err != nil {
+			return fc, err
+		}
+		return fc, setFaults(fc)
+	case len(args) == 1 && args[0] == "clear":
+		return faultConfig{}, setFaults(faultConfig{})
+	}
+	return faultConfig{}, errFaultArgs
+}
@@ -1,28 +1,21 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"os"
-	"strings"
+	"sort"
 	"time"
 )
 
-//Initialize membershipList with current time and local IP
-func initializeML() {
-	node := member{currHost, time.Now().Format(time.RFC850)}
-	membershipList = append(membershipList, node)
-}
-
 // returns 0 if not update, 1 if update
-func updateML(hostIndex int, msg message) int {
-	localTime, _ := time.Parse(time.RFC850, membershipList[hostIndex].TimeStamp)
+func updateML(s *groupState, hostIndex int, msg message) int {
+	localTime, _ := time.Parse(time.RFC850, s.Members[hostIndex].TimeStamp)
 	givenTime, _ := time.Parse(time.RFC850, msg.TimeStamp)
 
 	if givenTime.After(localTime) {
-		membershipList = append(membershipList[:hostIndex], membershipList[hostIndex+1:]...)
-		go writeMLtoFile()
+		s.Members = append(s.Members[:hostIndex], s.Members[hostIndex+1:]...)
 		return 1
 	} else {
 		//CHECK THIS LATER
@@ -30,16 +23,57 @@ func updateML(hostIndex int, msg message) int {
 	}
 }
 
-//Helper function to hard reset both timers (stop both and set resetFlags to 1)
-func resetTimers() {
-	resetFlags[0] = 1
-	resetFlags[1] = 1
-	timers[0].Reset(0)
-	timers[1].Reset(0)
+//Adds node to the membershipList, or replaces the entry for the same host if node is a newer incarnation
+//(the VM left and joined again). Returns false if the membershipList already has this incarnation.
+//A member that joins again is no longer sent reconnect probes. Must be called from updateState
+func addMember(s *groupState, node member) bool {
+	for i, element := range s.Members {
+		if element.Host == node.Host {
+			if node.Incarnation <= element.Incarnation {
+				return false
+			}
+			s.Members[i] = node
+			return true
+		}
+	}
+	s.Members = append(s.Members, node)
+	sort.Sort(memList(s.Members))
+	delete(s.Departed, node.Host)
+	return true
+}
+
+//Called after leaving the group. Stops probing by shrinking the membershipList back to just the local VM
+//and bumps the incarnation so a later join is treated as a new member rather than the one that left
+func resetMembership() {
+	updateState(func(s *groupState) bool {
+		clearProbes()
+		s.Incarnation++
+		s.Members = []member{{Host: currHost, TimeStamp: time.Now().Format(time.RFC850), Tags: conf().Tags, Incarnation: s.Incarnation,
+			MinVersion: conf().ProtocolMin, MaxVersion: conf().ProtocolMax}}
+		s.Connected = false
+		s.Departed = make(map[string]departedMember)
+		return true
+	})
+}
+
+//Sets the metadata tags of host in the membershipList. Returns false if host is not in the list
+func updateTags(host string, tags map[string]string) bool {
+	found := false
+	updateState(func(s *groupState) bool {
+		if i := s.indexOf(host); i != -1 {
+			s.Members[i].Tags = tags
+			found = true
+		}
+		return found
+	})
+	return found
 }
 
 //get local IP address in the form of a string
 func getIP() string {
+	if conf().AdvertiseAddr != "" {
+		return conf().AdvertiseAddr
+	}
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		errorCheck(err)
@@ -47,81 +81,56 @@ func getIP() string {
 	return addrs[1].String()
 }
 
-//get index for local VM in membershipList
-func getIndex() int {
-	for i, element := range membershipList {
-		if currHost == element.Host {
-			return i
-		}
+//Returns the IP the UDP servers and the log query server listen on: bind_addr, or the IP of the local
+//VM's address (advertise_addr) if it is empty. bind_addr 0.0.0.0 listens on every interface
+func bindAddr() string {
+	if conf().BindAddr != "" {
+		return conf().BindAddr
 	}
-	return -1
-}
-
-/*Takes the host for a member and checks its index with the index for the local VM. Returns 1 if
-host is (localIndex + 1)%N or 2 if host is (localIndex + 2)%N, where N is size of membershipList*/
-func getRelativeIndex(host string) int {
-	localIndex := getIndex()
-	if strings.Compare(membershipList[(localIndex+1)%len(membershipList)].Host, host) == 0 {
-		return 1
-	} else if strings.Compare(membershipList[(localIndex+2)%len(membershipList)].Host, host) == 0 {
-		return 2
+	ip, _, err := net.ParseCIDR(currHost)
+	if err != nil {
+		return ""
 	}
-	return -1
+	return ip.String()
 }
 
 //Helper function to log errors
 func errorCheck(err error) {
 	if err != nil {
-		errlog.Println(err)
+		logError(nodeLog, err)
 	}
 }
 
-//Helper function to log general information
-func infoCheck(info string) {
-	infolog.Println(info)
-}
-
-//Helper function to log joining, failing, and leaving
+//Helper function to log joining, failing, and leaving and record them as events for the admin API and the journal.
+//Called once the message has changed the membershipList, outside updateState since the journal writes to disk
 func msgCheck(msg message) {
 	switch msg.Status {
 	case "Joining":
-		joinlog.Println("IP: " + msg.Host)
+		membershipLog.Info("Member joined", peerAttr(msg.Host), incarnationAttr(msg.Incarnation))
+		recordEvent(msg.Host, "joined", msg.Incarnation, msg.Reporter)
 	case "Failed":
-		faillog.Println("IP: " + msg.Host)
+		membershipLog.Warn("Member failed", peerAttr(msg.Host), incarnationAttr(msg.Incarnation))
+		recordEvent(msg.Host, "failed", msg.Incarnation, msg.Reporter)
 	case "Adios":
-		leavelog.Println("IP: " + msg.Host)
+		membershipLog.Info("Member left", peerAttr(msg.Host), incarnationAttr(msg.Incarnation))
+		recordEvent(msg.Host, "left", msg.Incarnation, msg.Reporter)
 	default:
-		infolog.Println("IP: " + msg.Host + " -> Status: " + msg.Status)
+		membershipLog.Info("Membership message", peerAttr(msg.Host), typeAttr(msg.Status))
 	}
 }
 
 //Sets currHost to local IP (as a string)
-//Sets membershipList with currHost as its only member with current time
-//Initializes timers with MAX_TIME and subsequently stops them. This is to prevent false firing of timers when Syn/Ack begins
+//Starts the state loop with currHost as the only member of the membershipList
 func initializeVars() {
+	initializeLogging()
 	currHost = getIP()
-	initializeML()
-	timers[0] = time.NewTimer(MAX_TIME)
-	timers[1] = time.NewTimer(MAX_TIME)
-	timers[0].Stop()
-	timers[1].Stop()
+	initializeState(initializePersistence())
 
 	rand.Seed(time.Now().UTC().UnixNano())
-
-	logfile_exists := 1
-	if _, err := os.Stat("logfile.log"); os.IsNotExist(err) {
-		logfile_exists = 0
+	initializeJournal()
+	if fc := conf().Faults; len(fc.Rules) > 0 || len(fc.Partitions) > 0 {
+		setFaults(fc)
 	}
 
-	logfile, _ := os.OpenFile("logfile.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	errlog = log.New(logfile, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	infolog = log.New(logfile, "INFO: ", log.Ldate|log.Ltime)
-	joinlog = log.New(logfile, "JOINING: ", log.Ldate|log.Ltime)
-	leavelog = log.New(logfile, "LEAVING: ", log.Ldate|log.Ltime)
-	faillog = log.New(logfile, "FAILED: ", log.Ldate|log.Ltime)
-	emptylog = log.New(logfile, "\n----------------------------------------------------------------------------------------\n", log.Ldate|log.Ltime)
-
-	if logfile_exists == 1 {
-		emptylog.Println("")
-	}
+	nodeLog.Info("Node started", slog.String("host", currHost), incarnationAttr(snapshot().Incarnation), slog.Int("pid", os.Getpid()))
 }
@@ -2,112 +2,215 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/gob"
 	"fmt"
-	"net"
-	"os"
-	"strings"
+	"log/slog"
+	"math/rand"
+	"sync"
 	"time"
 )
 
-//Called by introducer after receiving a join message. Compares timestamp of the message and.
-//the membershiplist. If timestamp in memberhiplist is more recent than message time, return 1
-// otherwise return 0
-func checkTimeStamp(m member) int {
-	for _, element := range membershipList {
-		if m.Host == element.Host {
-			t1, _ := time.Parse(time.RFC850, m.TimeStamp)
-			t2, _ := time.Parse(time.RFC850, element.TimeStamp)
-			if t2.After(t1) {
-				element = m
-				return 1
-			} else {
-				break
-			}
-		}
-	}
-	return 0
+//Outcome of the last introducer start, reported by GET /v1/recovery and swimctl recovery
+type recoveryReport struct {
+	//recovered, new group, running (members are still being checked) or not the introducer
+	Outcome string `json:"outcome"`
+	Policy  string `json:"policy"`
+	//When the saved state was written and when the recovery started and finished
+	Saved    string `json:"saved,omitempty"`
+	Started  string `json:"started,omitempty"`
+	Finished string `json:"finished,omitempty"`
+	//Members that answered isAlive and are still part of the group, members that answered but are no
+	//longer part of it (they left or restarted), and members that never answered
+	Confirmed   []string `json:"confirmed"`
+	Dropped     []string `json:"dropped"`
+	Unreachable []string `json:"unreachable"`
 }
 
-//Helper function to write membershipList to file
-func writeMLtoFile() {
-	if strings.Compare(currHost, INTRODUCER) == 0 {
-		f, err := os.Create(FILE_PATH)
-		errorCheck(err)
-		defer f.Close()
-		writer := bufio.NewWriter(f)
-		for _, element := range membershipList {
-			fmt.Fprintln(writer, element.Host)
-		}
-		writer.Flush()
-	}
+var recovery = recoveryReport{Outcome: "not the introducer", Confirmed: []string{}, Dropped: []string{}, Unreachable: []string{}}
+
+//isAlive waiting for an answer: the nonce it carries and where the answer goes
+type livenessCheck struct {
+	nonce uint64
+	reply chan string
 }
 
-//Helper function to convert file to membershiplist
-func fileToML() {
-	currTime := time.Now().Format(time.RFC850)
-	file, err := os.Open(FILE_PATH)
-	errorCheck(err)
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		node := member{scanner.Text(), currTime}
-		if strings.Compare(node.Host, INTRODUCER) != 0 {
-			membershipList = append(membershipList, node)
+//isAlive's waiting for an answer, by host
+var livenessChecks = make(map[string]livenessCheck)
+
+//Mutex used for recovery and livenessChecks
+var recoveryMutex = &sync.Mutex{}
+
+//Called when the introducer starts. If a membershipList was saved, recovery_policy decides whether the
+//group is rebuilt from it (always), a new group is started (never) or the user is asked (ask, only
+//possible with the interactive menu)
+func startIntroducer(reader *bufio.Reader) {
+	policy := conf().RecoveryPolicy
+	setRecovery(func(r *recoveryReport) { r.Policy = policy; r.Outcome = "new group" })
+	if !hasSavedMembers() {
+		persistState()
+		return
+	}
+	setRecovery(func(r *recoveryReport) { r.Saved = savedState.Saved })
+
+	if policy == "ask" && *daemon {
+		//Nobody can answer the prompt, assume we are being restarted after a crash
+		recoveryLog.Info("No terminal to ask whether to recover, recovering", slog.String("policy", policy))
+		policy = "always"
+	}
+	if policy == "ask" {
+		fmt.Println("\nA membership list was saved in " + statePath() + ".")
+		fmt.Print("Would you like to restart the connection using the existing membership list? y/n\n\n")
+		input, _ := reader.ReadString('\n')
+		if input == "y\n" {
+			policy = "always"
+		} else {
+			policy = "never"
 		}
 	}
-	validFlags = make([]int, len(membershipList))
-	for i := 0; i < len(membershipList); i++ {
-		validFlags[i] = 0
+	if policy == "never" {
+		recoveryLog.Info("Starting a new group, ignoring saved state", slog.String("file", statePath()))
+		persistState()
+		return
 	}
+	restartIntroducer()
 }
 
-//Function for introducer to send "isAlive" messages to VM's in it's membershiplist after reboot
-//This is to check validity of local membershipList is introducer crashes and needs to restart
-func checkMLValid() {
-	localip, _, _ := net.ParseCIDR(currHost)
-	LocalAddr, err := net.ResolveUDPAddr("udp", localip.String()+":0")
-	errorCheck(err)
-
-	for index, element := range membershipList {
-		msg := message{currHost, "isAlive", time.Now().Format(time.RFC850)}
-		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
-			errorCheck(err)
+//Rebuilds the membershipList from the saved state after the introducer restarts, drops members that
+//no longer respond and sends the result to the rest of the group
+func restartIntroducer() {
+	recoveryLog.Info("Restarting introducer from saved state", slog.String("file", statePath()))
+	setRecovery(func(r *recoveryReport) { r.Outcome = "running"; r.Started = time.Now().Format(time.RFC3339Nano) })
+	var hosts []string
+	updateState(func(s *groupState) bool {
+		restoreMembers(s)
+		hosts = s.others()
+		return true
+	})
+
+	answers := checkLiveness(hosts)
+
+	var confirmed, dropped, unreachable []string
+	//Journaled once the state loop is done with the list, so it does not wait on the journal file
+	var departures []event
+	updateState(func(s *groupState) bool {
+		kept := make([]member, 0, len(s.Members))
+		for _, element := range s.Members {
+			switch answers[element.Host] {
+			case "yup":
+				confirmed = append(confirmed, element.Host)
+			case "nope":
+				dropped = append(dropped, element.Host)
+				departures = append(departures, event{Host: element.Host, Type: "left", Incarnation: element.Incarnation})
+				continue
+			case "":
+				if element.Host != currHost {
+					unreachable = append(unreachable, element.Host)
+					departures = append(departures, event{Host: element.Host, Type: "failed", Incarnation: element.Incarnation})
+					s.markDeparted(element)
+					continue
+				}
+			}
+			kept = append(kept, element)
 		}
-		if element.Host != currHost {
-			go func(LA *net.UDPAddr, host string, bufMsg bytes.Buffer) {
-				ip, _, _ := net.ParseCIDR(host)
+		s.Members = kept
+		return true
+	})
+	for _, e := range departures {
+		recordEvent(e.Host, e.Type, e.Incarnation, currHost)
+	}
+
+	recoveryLog.Info("Recovered group from saved state", slog.Any("confirmed", confirmed), slog.Any("dropped", dropped), slog.Any("unreachable", unreachable))
+	setRecovery(func(r *recoveryReport) {
+		r.Outcome = "recovered"
+		r.Finished = time.Now().Format(time.RFC3339Nano)
+		r.Confirmed = append(r.Confirmed, confirmed...)
+		r.Dropped = append(r.Dropped, dropped...)
+		r.Unreachable = append(r.Unreachable, unreachable...)
+	})
+	errorCheck(saveState())
+	sendList()
+}
 
-				ServerAddr, err := net.ResolveUDPAddr("udp", ip.String()+":10000")
-				errorCheck(err)
+//Sends isAlive to every host, resending it every is_alive_interval until the host answers, is_alive_count
+//attempts were made or recovery_wait runs out. Returns the answer of each host that answered: yup if it
+//is still part of the group, nope if it is not
+func checkLiveness(hosts []string) map[string]string {
+	answers := make(map[string]string)
+	var answersMutex sync.Mutex
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(conf().RecoveryWait.Duration)
 
-				conn, err := net.DialUDP("udp", LA, ServerAddr)
-				errorCheck(err)
-				for i := 0; i < 5; i++ {
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			nonce := rand.Uint64()
+			reply := make(chan string, 1)
+			recoveryMutex.Lock()
+			livenessChecks[host] = livenessCheck{nonce, reply}
+			recoveryMutex.Unlock()
+			defer func() {
+				recoveryMutex.Lock()
+				delete(livenessChecks, host)
+				recoveryMutex.Unlock()
+			}()
 
-					_, err = conn.Write(bufMsg.Bytes())
-					errorCheck(err)
-					time.Sleep(50 * time.Millisecond)
+			msg := newMsg(currHost, "isAlive")
+			msg.Nonce = nonce
+			for attempt := 1; attempt <= conf().IsAliveCount && time.Now().Before(deadline); attempt++ {
+				sendMsg(msg, []string{host})
+				wait := min(conf().IsAliveInterval.Duration, time.Until(deadline))
+				select {
+				case answer := <-reply:
+					recoveryLog.Debug("Member answered isAlive", peerAttr(host), slog.String("answer", answer), slog.Int("attempt", attempt))
+					answersMutex.Lock()
+					answers[host] = answer
+					answersMutex.Unlock()
+					return
+				case <-time.After(wait):
 				}
-			}(LocalAddr, membershipList[index].Host, buf)
-		}
+			}
+			recoveryLog.Warn("Member did not answer isAlive", peerAttr(host), slog.Int("attempts", conf().IsAliveCount))
+		}(host)
 	}
+	wg.Wait()
+	return answers
 }
 
-//After sending isAlive messages and waiting for a yup response, introducer updates
-// it's membershipList according to the validFlags array. Indexes with value 0 means
-// VM didn't respond. 1 means VM responded.
-func checkValidFlags() {
-	time.Sleep(3 * time.Second)
-	i := 0
-	for j := 0; j < len(validFlags); j++ {
-		if validFlags[j] == 0 && membershipList[i].Host != INTRODUCER {
-			infoCheck(membershipList[i].Host + " Left or failed")
-			membershipList = append(membershipList[:i], membershipList[i+1:]...)
-		} else {
-			i++
-		}
+//Called when a member answers isAlive with yup or nope. Answers must carry the nonce of the isAlive,
+//except those of older builds which carry none
+func recordLiveness(msg message) {
+	recoveryMutex.Lock()
+	defer recoveryMutex.Unlock()
+	check, ok := livenessChecks[msg.Host]
+	if !ok || (msg.Nonce != check.nonce && msg.Nonce != 0) {
+		recoveryLog.Debug("Ignoring unexpected answer to isAlive", peerAttr(msg.Host), typeAttr(msg.Status))
+		return
+	}
+	select {
+	case check.reply <- msg.Status:
+	default:
 	}
 }
+
+//Answers an isAlive from a restarted introducer: yup if we are still part of the group, nope otherwise
+func answerIsAlive(msg message) {
+	status := "nope"
+	if snapshot().Connected {
+		status = "yup"
+	}
+	reply := newMsg(currHost, status)
+	reply.Nonce = msg.Nonce
+	sendMsg(reply, []string{msg.Host})
+}
+
+func setRecovery(update func(r *recoveryReport)) {
+	recoveryMutex.Lock()
+	update(&recovery)
+	recoveryMutex.Unlock()
+}
+
+func getRecovery() recoveryReport {
+	recoveryMutex.Lock()
+	defer recoveryMutex.Unlock()
+	return recovery
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+//States a member goes through in the journal. A member seen for the first time has no old state
+const (
+	STATE_ALIVE  = "alive"
+	STATE_FAILED = "failed"
+	STATE_LEFT   = "left"
+)
+
+//One membership transition, kept short since the journal is never truncated
+type journalEntry struct {
+	Time        string `json:"t"`
+	Host        string `json:"h"`
+	Old         string `json:"o,omitempty"`
+	New         string `json:"n"`
+	Incarnation int    `json:"i"`
+	By          string `json:"by,omitempty"`
+}
+
+//Filter for journal queries. Empty fields match everything. Host may be given with or without the /mask
+type journalQuery struct {
+	Host  string `json:"host,omitempty"`
+	State string `json:"state,omitempty"`
+	Since string `json:"since,omitempty"`
+	Until string `json:"until,omitempty"`
+}
+
+//Journal file, nil if journal_file is empty
+var journal *os.File
+
+//Last journaled entry of every member, its state is the old state of the member's next transition
+var journalStates = make(map[string]journalEntry)
+
+//Mutex used for journal and journalStates
+var journalMutex = &sync.Mutex{}
+
+var errNoJournal = errors.New("journal_file is not set, the journal is disabled")
+
+//State a member is in after an event of eventType
+var eventStates = map[string]string{"joined": STATE_ALIVE, "failed": STATE_FAILED, "left": STATE_LEFT}
+
+//Opens journal_file for appending and replays it so the next transition of every member has its old state
+func initializeJournal() {
+	if conf().JournalFile == "" {
+		return
+	}
+	if err := replayJournal(func(e journalEntry) { journalStates[e.Host] = e }); err != nil && !os.IsNotExist(err) {
+		errorCheck(err)
+	}
+	f, err := os.OpenFile(conf().JournalFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		errorCheck(err)
+		return
+	}
+	journal = f
+}
+
+//Appends the transition caused by e to the journal. Returns false, and journals nothing, if e is not a
+//transition: the member is already in the state e leads to at the same incarnation (e.g. the introducer
+//reported as joined again by the list that answers a rejoin)
+func journalEvent(e event) bool {
+	state, ok := eventStates[e.Type]
+	if !ok {
+		return true
+	}
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	last, known := journalStates[e.Host]
+	if known && last.New == state && last.Incarnation == e.Incarnation {
+		return false
+	}
+	//States are tracked even without a journal file, for the members by state metric
+	entry := journalEntry{time.Now().Format(time.RFC3339Nano), e.Host, last.New, state, e.Incarnation, e.By}
+	journalStates[e.Host] = entry
+	if journal == nil {
+		return true
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		errorCheck(err)
+		return true
+	}
+	//One write per entry so a crash can at most cut off the last line
+	_, err = journal.Write(append(b, '\n'))
+	errorCheck(err)
+	return true
+}
+
+//Returns a copy of the last journaled state of every member
+func lastStates() map[string]string {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	states := make(map[string]string, len(journalStates))
+	for host, entry := range journalStates {
+		states[host] = entry.New
+	}
+	return states
+}
+
+//Calls fn with every entry of the journal file, oldest first. Lines that cannot be decoded are skipped
+func replayJournal(fn func(journalEntry)) error {
+	f, err := os.Open(conf().JournalFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			fn(e)
+		}
+	}
+	return scanner.Err()
+}
+
+//Returns the journal entries matching q, oldest first
+func queryJournal(q journalQuery) ([]journalEntry, error) {
+	if conf().JournalFile == "" {
+		return nil, errNoJournal
+	}
+	since, err := parseQueryTime(q.Since)
+	if err != nil {
+		return nil, errors.New("since: " + err.Error())
+	}
+	until, err := parseQueryTime(q.Until)
+	if err != nil {
+		return nil, errors.New("until: " + err.Error())
+	}
+
+	entries := make([]journalEntry, 0)
+	err = replayJournal(func(e journalEntry) {
+		if (q.Host != "" && hostIP(e.Host) != hostIP(q.Host)) || (q.State != "" && e.New != q.State) {
+			return
+		}
+		if !since.IsZero() || !until.IsZero() {
+			t, err := time.Parse(time.RFC3339Nano, e.Time)
+			if err != nil || (!since.IsZero() && t.Before(since)) || (!until.IsZero() && t.After(until)) {
+				return
+			}
+		}
+		entries = append(entries, e)
+	})
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	return entries, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Journals to a file in a temporary directory until the test ends and returns its path
+func useJournal(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	setConfig(func(c *config) { c.JournalFile = path })
+	initializeJournal()
+	t.Cleanup(func() {
+		journalMutex.Lock()
+		journal.Close()
+		journal = nil
+		journalMutex.Unlock()
+		setConfig(func(c *config) { c.JournalFile = "" })
+	})
+	return path
+}
+
+//Returns the lines of the journal file
+func journalLines(t *testing.T, path string) []string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(b))
+}
+
+//A Failed message that does not change the membershipList is not journaled, one that does is
+func TestOnlyAppliedFailuresJournaled(t *testing.T) {
+	setMembers(t, 2)
+	path := useJournal(t)
+
+	stale := newMsg(testHost(2), "Failed")
+	stale.Incarnation = 1
+	stale.TimeStamp = time.Now().Add(-2 * time.Hour).Format(time.RFC850)
+	propagateMsg(stale)
+	if snapshot().indexOf(testHost(2)) == -1 {
+		t.Fatal("stale Failed removed the member")
+	}
+	if lines := journalLines(t, path); len(lines) > 0 {
+		t.Fatalf("stale Failed journaled: %v", lines)
+	}
+
+	fresh := newMsg(testHost(2), "Failed")
+	fresh.Incarnation = 1
+	propagateMsg(fresh)
+	if lines := journalLines(t, path); len(lines) != 1 || !strings.Contains(lines[0], `"n":"failed"`) {
+		t.Fatalf("journal after the member failed: %v", lines)
+	}
+}
+
+//An event that leaves the member in the state it is in at the same incarnation is not a transition
+func TestRepeatedStateNotJournaled(t *testing.T) {
+	setMembers(t)
+	path := useJournal(t)
+	before := len(recentEvents(-1))
+
+	recordEvent(testHost(2), "joined", 1, testHost(1))
+	recordEvent(testHost(2), "joined", 1, testHost(1))
+	if lines := journalLines(t, path); len(lines) != 1 {
+		t.Fatalf("joined journaled %d times at the same incarnation: %v", len(lines), lines)
+	}
+	recordEvent(testHost(2), "joined", 2, testHost(1))
+	if lines := journalLines(t, path); len(lines) != 2 {
+		t.Fatalf("rejoin with a new incarnation not journaled: %v", lines)
+	}
+	if added := len(recentEvents(-1)) - before; added != 2 && len(recentEvents(-1)) < MAX_EVENTS {
+		t.Fatalf("%d events recorded, want 2", added)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Subsystems that can be given their own level with log_levels
+const (
+	LOG_NODE       = "node"       //startup, config, admin API and swimctl
+	LOG_MEMBERSHIP = "membership" //joins, leaves, failures and membership list updates
+	LOG_PROBE      = "probe"      //SYN/ACK probing and failure detection
+	LOG_NET        = "net"        //sending and receiving packets
+	LOG_RECOVERY   = "recovery"   //introducer restart
+)
+
+var logSubsystems = []string{LOG_NODE, LOG_MEMBERSHIP, LOG_PROBE, LOG_NET, LOG_RECOVERY}
+
+//Handler every logger writes through. Replaced when the log file is (re)opened
+var baseHandler atomic.Value
+
+//Minimum level of each subsystem, rebuilt from log_level and log_levels on startup and reload
+var logLevels = make(map[string]slog.Level)
+
+//Level for subsystems not in logLevels
+var defaultLevel = slog.LevelInfo
+
+//Mutex used for logLevels and defaultLevel
+var logLevelMutex = &sync.RWMutex{}
+
+//File the log is written to, nil when logging to stdout
+var logWriter *rotatingFile
+
+//One logger per subsystem
+var nodeLog = newLogger(LOG_NODE)
+var membershipLog = newLogger(LOG_MEMBERSHIP)
+var probeLog = newLogger(LOG_PROBE)
+var netLog = newLogger(LOG_NET)
+var recoveryLog = newLogger(LOG_RECOVERY)
+
+//Filters records by the level of its subsystem and writes them through baseHandler
+type subsystemHandler struct {
+	subsystem string
+	attrs     []slog.Attr
+}
+
+func newLogger(subsystem string) *slog.Logger {
+	return slog.New(subsystemHandler{subsystem: subsystem})
+}
+
+func (h subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= levelFor(h.subsystem)
+}
+
+func (h subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	base, ok := baseHandler.Load().(slog.Handler)
+	if !ok {
+		return nil
+	}
+	r.AddAttrs(slog.String("subsystem", h.subsystem))
+	r.AddAttrs(h.attrs...)
+	return base.Handle(ctx, r)
+}
+
+func (h subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	all := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	all = append(all, h.attrs...)
+	all = append(all, attrs...)
+	return subsystemHandler{h.subsystem, all}
+}
+
+//Groups are not used by the node, attributes stay at the top level
+func (h subsystemHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+//Returns the minimum level logged for subsystem
+func levelFor(subsystem string) slog.Level {
+	logLevelMutex.RLock()
+	defer logLevelMutex.RUnlock()
+	if level, ok := logLevels[subsystem]; ok {
+		return level
+	}
+	return defaultLevel
+}
+
+//Parses debug, info, warn or error
+func parseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, errors.New("unknown log level " + name + ", expected debug, info, warn or error")
+	}
+	return level, nil
+}
+
+//Checks log_level, log_format, log_levels and the rotation settings from the config
+func validateLogConfig(c config) error {
+	if _, err := parseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log_level: %v", err)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return errors.New("log_format must be text or json")
+	}
+	if c.LogMaxSize < 0 || c.LogMaxAge.Duration < 0 || c.LogMaxBackups < 0 {
+		return errors.New("log_max_size, log_max_age and log_max_backups must not be negative")
+	}
+	for subsystem, name := range c.LogLevels {
+		known := false
+		for _, s := range logSubsystems {
+			known = known || s == subsystem
+		}
+		if !known {
+			return errors.New("log_levels: unknown subsystem " + subsystem + ", expected one of " + strings.Join(logSubsystems, ", "))
+		}
+		if _, err := parseLevel(name); err != nil {
+			return fmt.Errorf("log_levels: %v", err)
+		}
+	}
+	return nil
+}
+
+//Applies log_level and log_levels. Called at startup and on reload
+func setLogLevels(level string, levels map[string]string) {
+	logLevelMutex.Lock()
+	defer logLevelMutex.Unlock()
+	defaultLevel, _ = parseLevel(level)
+	logLevels = make(map[string]slog.Level)
+	for subsystem, name := range levels {
+		logLevels[subsystem], _ = parseLevel(name)
+	}
+}
+
+//Opens log_file (or stdout if it is "-") and starts writing records to it in log_format
+func initializeLogging() {
+	var out io.Writer = os.Stdout
+	if conf().LogFile != "-" {
+		r, err := openRotatingFile(conf().LogFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot open log file, logging to stdout: "+err.Error())
+		} else {
+			logWriter = r
+			out = r
+		}
+	}
+	setLogLevels(conf().LogLevel, conf().LogLevels)
+
+	//Filtering is done by subsystemHandler, the base handler takes everything
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if conf().LogFormat == "json" {
+		baseHandler.Store(slog.Handler(slog.NewJSONHandler(out, options)))
+	} else {
+		baseHandler.Store(slog.Handler(slog.NewTextHandler(out, options)))
+	}
+}
+
+//Attributes used throughout the logs
+func peerAttr(host string) slog.Attr {
+	return slog.String("peer", host)
+}
+
+func typeAttr(status string) slog.Attr {
+	return slog.String("type", status)
+}
+
+func incarnationAttr(incarnation int) slog.Attr {
+	return slog.Int("incarnation", incarnation)
+}
+
+func latencyAttr(latency time.Duration) slog.Attr {
+	return slog.Duration("latency", latency)
+}
+
+//Logs err at error level with the file and line of the caller of errorCheck
+func logError(logger *slog.Logger, err error) {
+	if _, file, line, ok := runtime.Caller(2); ok {
+		logger.Error(err.Error(), slog.String("caller", fmt.Sprintf("%s:%d", file[strings.LastIndex(file, "/")+1:], line)))
+		return
+	}
+	logger.Error(err.Error())
+}
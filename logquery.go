@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Log query sent by a client (admin API or swimctl) or by the member fanning the query out
+type logQuery struct {
+	//Regular expression matched against each line, empty matches every line
+	Pattern string `json:"pattern"`
+	//Minimum level (debug, info, warn or error)
+	Level string `json:"level,omitempty"`
+	//Time range, either RFC3339 or a duration meaning that long ago (e.g. "10m")
+	Since string `json:"since,omitempty"`
+	Until string `json:"until,omitempty"`
+	//Only search the log of the member receiving the query. Set on the queries sent to other members
+	Local bool `json:"local,omitempty"`
+	//cluster_name of the member sending the query. Queries from other clusters are refused
+	Cluster string `json:"cluster,omitempty"`
+}
+
+//One record of a query's result stream: a matching line, or the last record for a host with its number
+//of matches and the error if the host could not be searched
+type logResult struct {
+	Host    string `json:"host"`
+	Line    string `json:"line,omitempty"`
+	Done    bool   `json:"done,omitempty"`
+	Matches int    `json:"matches,omitempty"`
+	Error   string `json:"error,omitempty"`
+	//Sent by a member every query_timeout/2 while it searches, so the member asking does not give up on
+	//a long search that finds nothing. Never passed on to the client
+	Keepalive bool `json:"keepalive,omitempty"`
+}
+
+//Compiled form of a logQuery
+type logFilter struct {
+	pattern  *regexp.Regexp
+	level    slog.Level
+	hasLevel bool
+	since    time.Time
+	until    time.Time
+}
+
+//Finds the time and level of text ("time=... level=INFO") and JSON ("time":"...","level":"INFO") records
+var logTimeRegexp = regexp.MustCompile(`^time=(\S+)|"time":"([^"]+)"`)
+var logLevelRegexp = regexp.MustCompile(`(?:^|\s)level=([A-Z]+)|"level":"([A-Z]+)"`)
+
+//TCP listener for queries from other members, closed when the node stops
+var queryListener net.Listener
+
+var errLogToStdout = errors.New("log_file is stdout, nothing to search")
+
+func (q logQuery) compile() (logFilter, error) {
+	var f logFilter
+	var err error
+	if f.pattern, err = regexp.Compile(q.Pattern); err != nil {
+		return f, err
+	}
+	if q.Level != "" {
+		if f.level, err = parseLevel(q.Level); err != nil {
+			return f, err
+		}
+		f.hasLevel = true
+	}
+	if f.since, err = parseQueryTime(q.Since); err != nil {
+		return f, errors.New("since: " + err.Error())
+	}
+	if f.until, err = parseQueryTime(q.Until); err != nil {
+		return f, errors.New("until: " + err.Error())
+	}
+	return f, nil
+}
+
+//Parses an RFC3339 time or a duration before now. Returns the zero time for an empty string
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, errors.New("expected an RFC3339 time or a duration, got " + value)
+	}
+	return time.Now().Add(-d), nil
+}
+
+//Returns true if line matches the pattern, level and time range. Lines without a level or time
+//(e.g. written before structured logging) only match if the query does not filter on them
+func (f logFilter) match(line string) bool {
+	if !f.pattern.MatchString(line) {
+		return false
+	}
+	if f.hasLevel {
+		level, ok := submatch(logLevelRegexp, line)
+		if !ok {
+			return false
+		}
+		l, err := parseLevel(level)
+		if err != nil || l < f.level {
+			return false
+		}
+	}
+	if !f.since.IsZero() || !f.until.IsZero() {
+		value, ok := submatch(logTimeRegexp, line)
+		if !ok {
+			return false
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil || (!f.since.IsZero() && t.Before(f.since)) || (!f.until.IsZero() && t.After(f.until)) {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns the first non-empty group matched by re
+func submatch(re *regexp.Regexp, line string) (string, bool) {
+	for _, group := range re.FindStringSubmatch(line)[1:] {
+		if group != "" {
+			return group, true
+		}
+	}
+	return "", false
+}
+
+//Sends every line of the local log file that matches f to emit and returns the number of matches
+func searchLocalLog(f logFilter, emit func(logResult)) (int, error) {
+	if conf().LogFile == "-" {
+		return 0, errLogToStdout
+	}
+	file, err := os.Open(conf().LogFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	matches := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); f.match(line) {
+			emit(logResult{Host: currHost, Line: line})
+			matches++
+		}
+	}
+	return matches, scanner.Err()
+}
+
+//Runs q against the log of every current member (or only the local one if q.Local is set) and
+//streams the results to emit. Every host ends with a Done record. emit is never called concurrently
+func queryLogs(q logQuery, emit func(logResult)) error {
+	f, err := q.compile()
+	if err != nil {
+		return err
+	}
+
+	var emitMutex sync.Mutex
+	safeEmit := func(r logResult) {
+		emitMutex.Lock()
+		emit(r)
+		emitMutex.Unlock()
+	}
+	local := func() {
+		matches, err := searchLocalLog(f, safeEmit)
+		done := logResult{Host: currHost, Done: true, Matches: matches}
+		if err != nil {
+			done.Error = err.Error()
+		}
+		safeEmit(done)
+	}
+
+	if q.Local {
+		local()
+		return nil
+	}
+
+	members := snapshot().Members
+	hosts := make([]string, 0, len(members))
+	for _, element := range members {
+		hosts = append(hosts, element.Host)
+	}
+
+	nodeLog.Info("Querying logs", slog.String("pattern", q.Pattern), slog.Int("members", len(hosts)))
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if host == currHost {
+				local()
+			} else {
+				queryRemoteLog(host, q, safeEmit)
+			}
+		}(host)
+	}
+	wg.Wait()
+	return nil
+}
+
+//Sends q to the query server of host and passes its results on to emit. Reports hosts that cannot
+//be reached, or stop answering for query_timeout, in a Done record with an error
+func queryRemoteLog(host string, q logQuery, emit func(logResult)) {
+	matches := 0
+	fail := func(err error) {
+		netLog.Warn("Log query failed", peerAttr(host), slog.String("error", err.Error()))
+		emit(logResult{Host: host, Done: true, Matches: matches, Error: err.Error()})
+	}
+
+	ip, _, err := net.ParseCIDR(host)
+	if err != nil {
+		fail(err)
+		return
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(conf().QueryPort)), conf().QueryTimeout.Duration)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer conn.Close()
+
+	q.Local = true
+	q.Cluster = conf().ClusterName
+	if err := json.NewEncoder(conn).Encode(q); err != nil {
+		fail(err)
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(conf().QueryTimeout.Duration))
+		if !scanner.Scan() {
+			break
+		}
+		var r logResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			fail(err)
+			return
+		}
+		r.Host = host
+		if r.Keepalive {
+			continue
+		}
+		if r.Done {
+			emit(r)
+			return
+		}
+		matches++
+		emit(r)
+	}
+	if err := scanner.Err(); err != nil {
+		fail(err)
+		return
+	}
+	fail(errors.New("connection closed before the query finished"))
+}
+
+//Server answering log queries from other members. Queries received here only search the local log
+func queryServer() {
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddr(), strconv.Itoa(conf().QueryPort)))
+	if err != nil {
+		errorCheck(err)
+		return
+	}
+	defer listener.Close()
+	serversMutex.Lock()
+	queryListener = listener
+	serversMutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isStopping() {
+				return
+			}
+			errorCheck(err)
+			continue
+		}
+		go handleQuery(conn)
+	}
+}
+
+//Reads a single query from conn and streams the matching lines back, one JSON object per line. Every
+//record is written as soon as it is found, and keepalives are sent while the search runs, since the
+//member asking waits at most query_timeout for each line
+func handleQuery(conn net.Conn) {
+	defer conn.Close()
+
+	var q logQuery
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&q); err != nil {
+		errorCheck(err)
+		return
+	}
+	q.Local = true
+
+	encoder := json.NewEncoder(conn)
+	if q.Cluster != conf().ClusterName {
+		foreignMsgs.inc("LogQuery")
+		encoder.Encode(logResult{Host: currHost, Done: true, Error: fmt.Sprintf("member of cluster %q", conf().ClusterName)})
+		return
+	}
+
+	var writeMutex sync.Mutex
+	write := func(r logResult) {
+		writeMutex.Lock()
+		encoder.Encode(r)
+		writeMutex.Unlock()
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(conf().QueryTimeout.Duration / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				write(logResult{Host: currHost, Keepalive: true})
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	if err := queryLogs(q, write); err != nil {
+		write(logResult{Host: currHost, Done: true, Error: err.Error()})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//Points log_file at path and query_timeout at timeout until the test ends
+func setQueryConfig(t *testing.T, path string, timeout time.Duration) {
+	old := conf()
+	setConfig(func(c *config) {
+		c.LogFile = path
+		c.QueryTimeout = duration{timeout}
+	})
+	t.Cleanup(func() {
+		setConfig(func(c *config) {
+			c.LogFile = old.LogFile
+			c.QueryTimeout = old.QueryTimeout
+		})
+	})
+}
+
+//Sends q to handleQuery and returns a channel with the records it streams back, closed after the Done record
+func startQuery(t *testing.T, q logQuery) <-chan logResult {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go handleQuery(server)
+
+	q.Cluster = conf().ClusterName
+	if err := json.NewEncoder(client).Encode(q); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan logResult, 16)
+	go func() {
+		defer close(results)
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			var r logResult
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				return
+			}
+			results <- r
+			if r.Done {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+//Waits up to wait for the next record
+func nextResult(t *testing.T, results <-chan logResult, wait time.Duration) logResult {
+	t.Helper()
+	select {
+	case r, ok := <-results:
+		if !ok {
+			t.Fatal("query stream ended early")
+		}
+		return r
+	case <-time.After(wait):
+		t.Fatalf("nothing received for %v", wait)
+	}
+	return logResult{}
+}
+
+//A matching line reaches the member asking as soon as it is found and keepalives keep coming while the
+//search is still running, so a long search is not cut off by the query_timeout of the member asking
+func TestHandleQueryStreamsWhileSearching(t *testing.T) {
+	//Reads of a FIFO block until the writer closes it, standing in for a search through a large log
+	path := filepath.Join(t.TempDir(), "swim.log")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skip("cannot create a FIFO:", err)
+	}
+	timeout := 200 * time.Millisecond
+	setQueryConfig(t, path, timeout)
+
+	writer := make(chan *os.File, 1)
+	go func() {
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			close(writer)
+			return
+		}
+		file.WriteString("time=2026-01-01T00:00:00Z level=INFO msg=first\n")
+		writer <- file
+	}()
+	results := startQuery(t, logQuery{Pattern: "first", Local: true})
+
+	if r := nextResult(t, results, timeout); r.Line == "" || r.Keepalive {
+		t.Fatalf("matching line not sent while the search runs: %+v", r)
+	}
+	for i := 0; i < 3; i++ {
+		if r := nextResult(t, results, timeout); !r.Keepalive {
+			t.Fatalf("expected a keepalive while the search runs, got %+v", r)
+		}
+	}
+
+	file, ok := <-writer
+	if !ok {
+		t.Fatal("could not open the FIFO for writing")
+	}
+	file.Close()
+	r := nextResult(t, results, timeout)
+	for r.Keepalive {
+		r = nextResult(t, results, timeout)
+	}
+	if !r.Done || r.Matches != 1 {
+		t.Fatalf("expected a Done record with 1 match once the search ends, got %+v", r)
+	}
+}
+
+//Every line that matches is sent back, followed by a Done record with the number of matches
+func TestHandleQueryMatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swim.log")
+	lines := "time=2026-01-01T00:00:00Z level=INFO msg=joined\n" +
+		"time=2026-01-01T00:00:01Z level=WARN msg=failed\n" +
+		"time=2026-01-01T00:00:02Z level=INFO msg=joined\n"
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setQueryConfig(t, path, time.Second)
+
+	matches := 0
+	for r := range startQuery(t, logQuery{Pattern: "joined", Local: true}) {
+		switch {
+		case r.Keepalive:
+		case r.Done:
+			if r.Error != "" || r.Matches != 2 || matches != 2 {
+				t.Fatalf("done record %+v after %d lines, expected 2 matches", r, matches)
+			}
+			return
+		default:
+			matches++
+		}
+	}
+	t.Fatal("query stream ended without a Done record")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+//Runs the tests with the local VM at 127.0.0.1 and the state loop started. Messages are sent to the
+//discard port so propagation never reaches a real node
+func TestMain(m *testing.M) {
+	setConfig(func(c *config) {
+		c.LogFile = "-"
+		c.LogLevel = "error"
+		c.JournalFile = ""
+		c.MessagePort = 9
+		c.ListPort = 9
+	})
+	initializeLogging()
+	currHost = testHost(1)
+	initializeState(1)
+	os.Exit(m.Run())
+}
+
+//Changes the effective configuration for a test
+func setConfig(change func(c *config)) {
+	cfgMutex.Lock()
+	change(&cfg)
+	cfgMutex.Unlock()
+}
+
+//Returns the address of the i'th test VM
+func testHost(i int) string {
+	return fmt.Sprintf("127.0.%d.%d/8", i/256, i%256)
+}
+
+//Returns a member running this build that joined an hour ago, so messages created now are newer
+func testMember(i int, incarnation int) member {
+	return member{Host: testHost(i), TimeStamp: time.Now().Add(-time.Hour).Format(time.RFC850), Incarnation: incarnation,
+		MinVersion: PROTOCOL_VERSION_MIN, MaxVersion: PROTOCOL_VERSION_MAX}
+}
+
+//Returns a member running a build without protocol versions or incarnations
+func oldMember(i int) member {
+	return member{Host: testHost(i), TimeStamp: time.Now().Add(-time.Hour).Format(time.RFC850)}
+}
+
+//Replaces the membershipList with the local VM and the test VM's in hosts and drops every probe,
+//departed member and journaled state
+func setMembers(t *testing.T, hosts ...int) {
+	t.Helper()
+	journalMutex.Lock()
+	journalStates = make(map[string]journalEntry)
+	journalMutex.Unlock()
+	updateState(func(s *groupState) bool {
+		clearProbes()
+		s.Members = []member{testMember(1, s.Incarnation)}
+		s.Departed = make(map[string]departedMember)
+		for _, i := range hosts {
+			addMember(s, testMember(i, 1))
+		}
+		s.Connected = true
+		return true
+	})
+}
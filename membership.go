@@ -4,51 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/gob"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
-	"sort"
-	"sync"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-//IP address, as a string, for the introducer - the VM that outher VM's will ping to join the group
-const INTRODUCER = "172.22.149.18/23"
-
-//File path for membershipList. Only applies to INTRODUCER
-const FILE_PATH = "MList.txt"
-
-//Minimum number of VM's in the group before Syn/Ack-ing begins
-const MIN_HOSTS = 5
-
-//Maximum time a VM will wait for an ACK from a machine before marking it as failed
-const MAX_TIME = time.Millisecond * 2500
-
 //IP of the local machine as a string
 var currHost string
 
-//Flag to indicate if the machine is currently connected to the group
-//1 = machine is connected, 0 = machine is not connected
-var isConnected int
-
-//Mutex used for membershipList and timers
-var mutex = &sync.Mutex{}
-
-//Timers for checking last ack - used in checkLastAck function
-//When timer reaches 0, corresponding VM is marked as failed unless reset flags are 1
-var timers [2]*time.Timer
-
-//resetFlags indicate whether timer went off or were stopped to reset the timers
-//1 = timers were forcefully stopped
-var resetFlags [2]int
-
-//Contains all members connected to the group
-var membershipList = make([]member, 0)
-
-//Used if introducer crashes and reboots using a locally stored membership list
-var validFlags []int
-
 //type and functions used to sort membershipLists
 type memList []member
 
@@ -56,19 +25,8 @@ func (slice memList) Len() int           { return len(slice) }
 func (slice memList) Less(i, j int) bool { return slice[i].Host < slice[j].Host }
 func (slice memList) Swap(i, j int)      { slice[i], slice[j] = slice[j], slice[i] }
 
-//For logging
-var logfile *os.File
-var errlog *log.Logger
-var infolog *log.Logger
-var joinlog *log.Logger
-var leavelog *log.Logger
-var faillog *log.Logger
-var emptylog *log.Logger
-
-//For simulating packet loss in percent
-const PACKET_LOSS = 0
-
-var packets_lost int
+//Largest UDP payload a server will read in one go
+const MAX_PACKET_SIZE = 65507
 
 //struct for information sent from client to server
 type message struct {
@@ -76,17 +34,66 @@ type message struct {
 	//port string
 	Status    string
 	TimeStamp string
+	//Vivaldi coordinate of the sender, only set on SYN's and ACK's
+	Coord coordinate
+	//Coordinates the sender knows about for other VM's, only set on ACK's
+	Coords map[string]coordinate
+	//Metadata of the sender, only set on Joining and Tags messages
+	Tags map[string]string
+	//Incarnation of Host. Messages about an older incarnation than the one in the membershipList are ignored
+	Incarnation int
+	//VM that created the message (e.g. the one that detected a failure). Kept when the message is propagated
+	Reporter string
+	//membershipList of the sender, only set on Merge and MergeReply messages
+	Members []member
+	//Random number set on isAlive and echoed in the answer, so answers to an earlier isAlive are not mistaken for it
+	Nonce uint64
+	//cluster_name of the sender. Messages from other clusters are dropped
+	Cluster string
+	//Protocol versions the sender speaks. Older builds leave them at 0, meaning version 1 only
+	MinVersion int
+	MaxVersion int
 }
 
 //Information kept for each VM in the group, stored in membershipList
 type member struct {
-	Host      string
-	TimeStamp string
+	Host        string
+	TimeStamp   string
+	Tags        map[string]string
+	Incarnation int
+	//Protocol versions the member speaks, as advertised when it joined
+	MinVersion int
+	MaxVersion int
 }
 
 //var startup = flag.Int("s", 0, "Value to decide if startup node")
 
+//In daemon mode there is no interactive menu, the node is controlled with swimctl or the admin API
+var daemon = flag.Bool("daemon", false, "Run without the interactive menu")
+
 func main() {
+	registerConfigFlags()
+	flag.Parse()
+
+	if *scenarioPath != "" {
+		os.Exit(runScenario(*scenarioPath))
+	}
+
+	var err error
+	if cfg, err = loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration: "+err.Error())
+		os.Exit(2)
+	}
+	if *printConfig {
+		printEffectiveConfig()
+		return
+	}
+
+	if err := lockDataDir(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EXIT_DATA_DIR_LOCKED)
+	}
+
 	fmt.Println("Harambe")
 	initializeVars()
 
@@ -94,153 +101,190 @@ func main() {
 	//updates from the introducer when new VM's join
 	go messageServer()
 	go membershipServer()
+	go httpServer()
+	go queryServer()
+	go controlServer()
+	go reloadOnSignal()
+	go reopenLogOnSignal()
+	go handleShutdownSignals()
 
 	//Reader to take console input from the user
 	reader := bufio.NewReader(os.Stdin)
 
 	//If VM is the introducer, follow protocol for storing membershipList as a local file
-	if currHost == INTRODUCER {
-		//If membershipList file exists, check is user wants to restart server using
-		//the file or start a new group
-		if _, err := os.Stat(FILE_PATH); os.IsNotExist(err) {
-			writeMLtoFile()
-		} else {
-			fmt.Println("\nA membership list exists in the current directory.")
-			fmt.Println("Would you like to restart the connection using the existing membership list? y/n\n")
-			input, _ := reader.ReadString('\n')
-			switch input {
-			case "y\n":
-				infoCheck("Restarting master...")
-				fileToML()
-				checkMLValid()
-				checkValidFlags()
-				writeMLtoFile()
-				sendList()
-			case "n\n":
-				writeMLtoFile()
-			default:
-				fmt.Println("Invalid command")
-			}
-		}
+	if currHost == conf().Introducer {
+		//If a membershipList was saved, recovery_policy decides whether to restart
+		//the group from it or start a new group
+		startIntroducer(reader)
+	} else {
+		//A VM that was part of a group before it restarted rejoins it through its last known peers
+		go autoRejoin()
 	}
 
 	//Start functions sending syn's and checking for ack's in seperate threads
-	go sendSyn()
-	go checkLastAck(1)
-	go checkLastAck(2)
+	go probeLoop()
+	go reconnectLoop()
+
+	if *daemon {
+		select {}
+	}
 
 	//Take user input
 	for {
 		fmt.Println("1 -> Print membership list")
 		fmt.Println("2 -> Print self ID")
 		fmt.Println("3 -> Join group")
-		fmt.Println("4 -> Leave group\n")
+		fmt.Println("4 -> Leave group")
+		fmt.Print("5 -> Print nearest members\n\n")
 		input, _ := reader.ReadString('\n')
 		switch input {
 		case "1\n":
-			for _, element := range membershipList {
+			for _, element := range snapshot().Members {
 				fmt.Println(element)
 			}
 		case "2\n":
 			fmt.Println(currHost)
 		case "3\n":
-			if currHost != INTRODUCER && isConnected == 0 {
-				fmt.Println("Joining group")
-				connectToIntroducer()
-				infoCheck(currHost + " is connecting to master")
-				isConnected = 1
-			} else {
+			switch err := joinGroup(conf().joinSeeds()); err {
+			case nil:
+				fmt.Println("Joined group")
+			case errIsIntroducer:
 				fmt.Println("I AM THE MASTER")
+			default:
+				fmt.Println(err)
+			}
+		case "5\n":
+			for _, host := range nearestMembers(currHost, -1) {
+				rtt, _ := estimateRTT(currHost, host)
+				fmt.Println(host + " -> " + rtt.String())
 			}
 		case "4\n":
-			if isConnected == 1 {
-				fmt.Println("Leaving group")
-				leaveGroup()
-				infoCheck(currHost + " left group")
-				os.Exit(0)
-
-			} else {
+			fmt.Println("Leaving group")
+			if confirmed, err := leave(); err != nil {
 				fmt.Println("You are currently not connected to a group")
+			} else if confirmed {
+				fmt.Println("Left group, type 3 to join again")
+			} else {
+				fmt.Println("Left group without confirmation, type 3 to join again")
 			}
 		default:
 			fmt.Println("Invalid command")
 		}
-		fmt.Println("\n\n")
+		fmt.Print("\n\n\n")
 	}
 }
 
 //Creates a server to respond to messages
 func messageServer() {
-	ServerAddr, err := net.ResolveUDPAddr("udp", ":10000")
+	ServerAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bindAddr(), strconv.Itoa(conf().MessagePort)))
 	errorCheck(err)
 
 	ServerConn, err := net.ListenUDP("udp", ServerAddr)
 	errorCheck(err)
 	defer ServerConn.Close()
+	serversMutex.Lock()
+	messageConn = ServerConn
+	serversMutex.Unlock()
 
-	buf := make([]byte, 1024)
+	buf := make([]byte, MAX_PACKET_SIZE)
 
 	for {
 		msg := message{}
-		n, _, err := ServerConn.ReadFromUDP(buf)
+		n, addr, err := ServerConn.ReadFromUDP(buf)
+		if err != nil {
+			if isStopping() {
+				return
+			}
+			errorCheck(err)
+			continue
+		}
+		if dropIncoming(addr.IP) {
+			continue
+		}
 		err = gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&msg)
-		errorCheck(err)
+		if err != nil {
+			errorCheck(err)
+			atomic.AddUint64(&decodeErrors, 1)
+			continue
+		}
+		if msg.Status != "ClusterMismatch" && !fromOurCluster(msg.Cluster, msg.Status, msg.Host, addr.IP) {
+			continue
+		}
+		msgsReceived.inc(msg.Status)
 		switch msg.Status {
-		/* 	if joining, create a member with the host and current time, add member to membershiplist,
-		sort the membershiplist, and sent list to all members in membershipList (only the introducer will receive
-		joing message.*/
+		/* 	if joining, create a member with the host and current time, add member to membershiplist (replacing
+		an older incarnation of the same host), sort the membershiplist, and sent list to all members in membershipList
+		(only the introducer will receive joing message.*/
 		case "Joining":
-			msgCheck(msg)
-			node := member{msg.Host, time.Now().Format(time.RFC850)}
-			if checkTimeStamp(node) == 0 {
-				mutex.Lock()
-				resetTimers()
-				membershipList = append(membershipList, node)
-				sort.Sort(memList(membershipList))
-				mutex.Unlock()
+			if currHost != conf().Introducer {
+				forwardJoin(msg)
+				continue
+			}
+			if !compatibleJoin(msg) {
+				continue
+			}
+			node := member{Host: msg.Host, TimeStamp: time.Now().Format(time.RFC850), Tags: msg.Tags, Incarnation: msg.Incarnation,
+				MinVersion: msg.MinVersion, MaxVersion: msg.MaxVersion}
+			added := false
+			updateState(func(s *groupState) bool {
+				added = addMember(s, node)
+				return added
+			})
+			if added {
+				msgCheck(msg)
 			}
-			go writeMLtoFile()
 			//propagateMsg(msg)
 			sendList()
+		/*	a member changed its metadata. Update it in the membershipList and send the list to the group
+			(like joining, only the introducer will receive this message)*/
+		case "Tags":
+			if updateTags(msg.Host, msg.Tags) {
+				sendList()
+			}
 		/*	if syn, send an ACK back to to the ip that sent the syn*/
 		case "SYN":
-			fmt.Print("Syn received from: ")
-			fmt.Println(msg.Host)
+			probeLog.Debug("SYN received", peerAttr(msg.Host))
+			mergeCoordinates(map[string]coordinate{msg.Host: msg.Coord})
 			sendAck(msg.Host)
-		/*	if ack, check if ip that sent the message is either (currIndex + 1)%N or (currIndex + 2)%N
-			and reset the corresponding timer to MAX_TIME*/
+		/*	if ack, the outstanding probe of the ip that sent the message is answered*/
 		case "ACK":
-			if msg.Host == membershipList[(getIndex()+1)%len(membershipList)].Host {
-				fmt.Print("ACK received from ")
-				fmt.Println(msg.Host)
-				timers[0].Reset(MAX_TIME)
-			} else if msg.Host == membershipList[(getIndex()+2)%len(membershipList)].Host {
-				fmt.Print("ACK received from ")
-				fmt.Println(msg.Host)
-				timers[1].Reset(MAX_TIME)
-			}
-		/*	if message status is failed, propagate the message (timers will be taken care of in checkLastAck*/
+			recordAck(msg.Host, msg.Coord)
+			mergeCoordinates(msg.Coords)
+			answerProbe(msg.Host)
+		/*	if message status is failed, propagate the message (the probe of the failed member is dropped by probeLoop)*/
 		case "Failed":
 			propagateMsg(msg)
-		/*	if a node leaves, propagate message and reset timers*/
+		/*	if a node leaves, propagate message and confirm to the leaving node that we got the message*/
 		case "Adios":
-			mutex.Lock()
-			resetTimers()
 			propagateMsg(msg)
-			mutex.Unlock()
-		/*	isAlive message is sent from introducer. Send a yup message back to let introducer know that that VM is
-			still in the group*/
+			sendAdiosAck(msg.Host)
+		/*	received by a node that is leaving the group*/
+		case "AdiosACK":
+			recordLeaveAck(msg.Host)
+		/*	a recently failed member or a seed reached us with its membershipList, the group may have been split*/
+		case "Merge", "MergeReply":
+			handleMerge(msg)
+		/*	a seed we sent Joining to belongs to another cluster*/
+		case "ClusterMismatch":
+			clusterMismatch(msg)
+		/*	the group we tried to join has no protocol version in common with us*/
+		case "VersionMismatch":
+			versionMismatch(msg)
+		/*	isAlive message is sent from a restarted introducer. Answer yup if this VM is still in the group,
+			nope if it is not*/
 		case "isAlive":
-			yup()
-		/*	received by introducer. valid flags will initially contain an array of 0's corresponding to each member
-			in the membershipList. The value will be updated to 1 if a yup is received from the corresponding VM*/
-		case "yup":
-			for i, element := range membershipList {
-				if msg.Host == element.Host {
-					validFlags[i] = 1
-					break
+			answerIsAlive(msg)
+		/*	received by the introducer while it checks which members of its saved membershipList are alive*/
+		case "yup", "nope":
+			updateState(func(s *groupState) bool {
+				i := s.indexOf(msg.Host)
+				if i == -1 {
+					return false
 				}
-			}
+				s.Members[i].MinVersion, s.Members[i].MaxVersion = msg.MinVersion, msg.MaxVersion
+				return true
+			})
+			recordLiveness(msg)
 
 		}
 	}
@@ -248,95 +292,71 @@ func messageServer() {
 
 //Server to receieve updated membershipList from introducer if a new member joins
 func membershipServer() {
-	ServerAddr, err := net.ResolveUDPAddr("udp", ":10001")
+	ServerAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bindAddr(), strconv.Itoa(conf().ListPort)))
 	errorCheck(err)
 
 	ServerConn, err := net.ListenUDP("udp", ServerAddr)
 	errorCheck(err)
 	defer ServerConn.Close()
+	serversMutex.Lock()
+	listConn = ServerConn
+	serversMutex.Unlock()
 
-	buf := make([]byte, 1024)
+	buf := make([]byte, MAX_PACKET_SIZE)
 
 	for {
-		mL := make([]member, 0)
-		n, _, err := ServerConn.ReadFromUDP(buf)
-		err = gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&mL)
-		errorCheck(err)
-
-		//restart timers if membershipList is updated
-		mutex.Lock()
-		resetTimers()
-		membershipList = mL
-		mutex.Unlock()
-
-		var msg = "New VM joined the group: \n\t["
-		var N = len(mL) - 1
-		for i, host := range mL {
-			msg += "(" + host.Host + " | " + host.TimeStamp + ")"
-			if i != N {
-				msg += ", \n\t"
-			} else {
-				msg += "]"
+		n, addr, err := ServerConn.ReadFromUDP(buf)
+		if err != nil {
+			if isStopping() {
+				return
 			}
+			errorCheck(err)
+			continue
 		}
-		infoCheck(msg)
-	}
-}
+		if dropIncoming(addr.IP) {
+			continue
+		}
+		mL, err := decodeList(buf[:n])
+		if err != nil {
+			errorCheck(err)
+			atomic.AddUint64(&decodeErrors, 1)
+			continue
+		}
+		if !fromOurCluster(mL.Cluster, "MembershipList", "", addr.IP) {
+			continue
+		}
+		msgsReceived.inc("MembershipList")
+		setProtocolVersion(mL.Version)
 
-//VM's are marked as failed if they have not responded with an ACK within MAX_TIME
-//2 checkLastAck calls persist at any given time, one to check the VM at (currIndex + 1)%N and one to
-//check the VM (currIndex + 2)%N, where N is the size of the membershipList
-//relativeIndex can be 1 or 2 and indicates what VM the function to watch
-//A timer for each of the two VM counts down from MAX_TIME and is reset whenever an ACK is received (handled in
-// messageServer function.
-//Timers are reset whenever the membershipList is modified
-//The timer will reach 0 if an ACK isn't received from the corresponding VM
-// within MAX_TIME, or the timer is reset. If a timer was reset, the corresponding resetFlag will be 1
-// and indicate that checkLastAck should be called again and that the failure detection should not be called
-//If a timer reaches 0 because an ACK was not received in time, the VM is marked as failed and th message is
-//propagated to the next 2 VM's in the membershipList. Both timers are then restarted.
-func checkLastAck(relativeIndex int) {
-	//Wait until number of members in group is at least MIN_HOSTS before checking for ACKs
-	for len(membershipList) < MIN_HOSTS {
-		time.Sleep(100 * time.Millisecond)
-	}
+		//A VM that left the group ignores lists still being sent to it
+		if !snapshot().Connected && currHost != conf().Introducer {
+			membershipLog.Debug("Ignoring membership list, not connected to a group")
+			continue
+		}
 
-	//Get host at (currIndex + relativeIndex)%N
-	host := membershipList[(getIndex()+relativeIndex)%len(membershipList)].Host
-	fmt.Print("Checking ")
-	fmt.Print(relativeIndex)
-	fmt.Print(": ")
-	fmt.Println(host)
-
-	//Create a new timer and hold until timer reaches 0 or is reset
-	timers[relativeIndex-1] = time.NewTimer(MAX_TIME)
-	<-timers[relativeIndex-1].C
-
-	/*	3 conditions will prevent failure detection from going off
-		1. Number of members is less than the MIN_HOSTS
-		2. The target host's relative index is no longer the same as when the checkLastAck function was called. Meaning
-		the membershipList has been updated and the checkLastAck should update it's host
-		3. resetFlags for the corresponding timer is set to 1, again meaning that the membership list was updated and
-		checkLastack needs to reset the VM it is monitoring.*/
-	mutex.Lock()
-	if len(membershipList) >= MIN_HOSTS && getRelativeIndex(host) == relativeIndex && resetFlags[relativeIndex-1] != 1 {
-		msg := message{membershipList[(getIndex()+relativeIndex)%len(membershipList)].Host, "Failed", time.Now().Format(time.RFC850)}
-		fmt.Print("Failure detected: ")
-		fmt.Println(msg.Host)
-		propagateMsg(msg)
+		known := make(map[string]int)
+		updateState(func(s *groupState) bool {
+			for _, element := range s.Members {
+				known[element.Host] = element.Incarnation
+			}
+			//A copy, the state loop changes its membershipList in place while mL is still read below
+			s.Members = slices.Clone(mL.Members)
+			s.forgetDeparted(mL.Members)
+			return true
+		})
+		signalJoin(nil)
+
+		//Lists are only sent by the introducer, which is who reported the join
+		for _, element := range mL.Members {
+			if inc, ok := known[element.Host]; (!ok || element.Incarnation > inc) && element.Host != currHost {
+				recordEvent(element.Host, "joined", element.Incarnation, conf().Introducer)
+			}
+		}
 
+		hosts := make([]string, 0, len(mL.Members))
+		for _, element := range mL.Members {
+			hosts = append(hosts, element.Host)
+		}
+		membershipLog.Info("Membership list updated", slog.Int("members", len(mL.Members)), slog.Any("hosts", hosts))
 	}
-	//If a failure is detected for one timer, reset the other as well.
-	if resetFlags[relativeIndex-1] == 0 {
-		fmt.Print("Force stopping timer")
-		fmt.Println(relativeIndex)
-		resetFlags[relativeIndex%2] = 1
-		timers[relativeIndex%2].Reset(0)
-	} else {
-		resetFlags[relativeIndex-1] = 0
-	}
-
-	mutex.Unlock()
-	go checkLastAck(relativeIndex)
-
 }
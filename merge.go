@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+//Member removed after being marked as Failed, kept for reconnect_timeout in case it was only cut off by a partition
+type departedMember struct {
+	member member
+	failed time.Time
+}
+
+//Remembers a member that was marked as Failed so reconnect probes are sent to it. Must be called from
+//updateState
+func (s *groupState) markDeparted(m member) {
+	s.Departed[m.Host] = departedMember{m, time.Now()}
+}
+
+//Stops sending reconnect probes to hosts that are members again. Returns true if any was departed.
+//Must be called from updateState
+func (s *groupState) forgetDeparted(members []member) bool {
+	changed := false
+	for _, element := range members {
+		if _, ok := s.Departed[element.Host]; ok {
+			delete(s.Departed, element.Host)
+			changed = true
+		}
+	}
+	return changed
+}
+
+//Returns the departed hosts, dropping the ones that failed more than reconnect_timeout ago
+func departedHosts() []string {
+	var hosts []string
+	updateState(func(s *groupState) bool {
+		changed := false
+		for host, d := range s.Departed {
+			if time.Since(d.failed) > conf().ReconnectTimeout.Duration {
+				delete(s.Departed, host)
+				changed = true
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+		return changed
+	})
+	return hosts
+}
+
+//Every reconnect_interval, sends our membership list in a Merge message to the recently failed members
+//and to the seeds that are not in the membershipList. If the group was split by a partition, the first
+//probe to get through after the network heals lets the two halves find each other again
+func reconnectLoop() {
+	for !isStopping() {
+		interval := conf().ReconnectInterval.Duration
+		if interval <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(interval)
+		s := snapshot()
+		if currHost != conf().Introducer && !s.Connected {
+			continue
+		}
+		//Merge carries the membershipList, which builds without protocol versions cannot take
+		if messageVersion() < 2 {
+			continue
+		}
+
+		targets := departedHosts()
+		msg := newMsg(currHost, "Merge")
+		msg.Members = s.Members
+		for _, seed := range conf().joinSeeds() {
+			if seed != currHost && !s.contains(seed) && !containsString(targets, seed) {
+				targets = append(targets, seed)
+			}
+		}
+
+		if len(targets) > 0 {
+			membershipLog.Debug("Sending reconnect probes", slog.Any("targets", targets))
+			sendMsg(msg, targets)
+		}
+	}
+}
+
+//Handles Merge and MergeReply messages. Only the introducer merges membership lists, since it is the only
+//VM that sends them: other members forward lists that have something new to the introducer, or, if their
+//part of the group has lost the introducer, answer a Merge with their own list in a MergeReply
+func handleMerge(msg message) {
+	s := snapshot()
+	news := !s.contains(msg.Host)
+	for _, m := range msg.Members {
+		news = news || !s.contains(m.Host)
+	}
+	introducer := currHost == conf().Introducer
+	hasIntroducer := s.contains(conf().Introducer)
+
+	if !news || (!introducer && !s.Connected) || messageVersion() < 2 {
+		return
+	}
+
+	switch {
+	case introducer:
+		mergeMembers(msg)
+	case hasIntroducer:
+		membershipLog.Debug("Forwarding membership list to the introducer", peerAttr(msg.Host), typeAttr(msg.Status))
+		sendMsg(msg, []string{conf().Introducer})
+	case msg.Status == "Merge":
+		reply := newMsg(currHost, "MergeReply")
+		reply.Members = s.Members
+		sendMsg(reply, []string{msg.Host})
+	}
+}
+
+//Adds the members of another part of the group to the membershipList and sends the result to everyone
+func mergeMembers(msg message) {
+	added := make([]string, 0)
+	updateState(func(s *groupState) bool {
+		for _, m := range msg.Members {
+			if addMember(s, m) {
+				added = append(added, m.Host)
+			}
+		}
+		return len(added) > 0
+	})
+
+	if len(added) == 0 {
+		return
+	}
+	atomic.AddUint64(&partitionMerges, 1)
+	membershipLog.Warn("Merged membership list of a split group", peerAttr(msg.Host), slog.Any("added", added))
+	for _, host := range added {
+		for _, m := range msg.Members {
+			if m.Host == host {
+				recordEvent(host, "joined", m.Incarnation, msg.Host)
+			}
+		}
+	}
+	sendList()
+}
@@ -3,168 +3,223 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
-	"fmt"
-	"math/rand"
+	"log/slog"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
+//Returns a message about host with the given status, stamped with the current time. Messages
+//about the local VM carry its incarnation, for other hosts the caller sets it
+func newMsg(host string, status string) message {
+	msg := message{Host: host, Status: status, TimeStamp: time.Now().Format(time.RFC850), Reporter: currHost, Cluster: conf().ClusterName,
+		MinVersion: conf().ProtocolMin, MaxVersion: conf().ProtocolMax}
+	if host == currHost {
+		msg.Incarnation = snapshot().Incarnation
+	}
+	return msg
+}
+
 //Handles connection protocol and writes message to server
 //Takes a message and the IP's of the VM's to send the message to as a slice of strings
-//Messages are encoded using golang's gobbing protocol
+//Messages are encoded using golang's gobbing protocol, at the version the group operates at
 func sendMsg(msg message, targetHosts []string) {
+	msg = msg.atVersion(messageVersion())
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
 		errorCheck(err)
 	}
 
+	for _, host := range targetHosts {
+		host := host
+		injectFaults(host, msg.Status, func() {
+			if sendUDP(host, conf().MessagePort, buf.Bytes()) {
+				msgsSent.inc(msg.Status)
+				netLog.Debug("Sent message", typeAttr(msg.Status), peerAttr(host), slog.String("about", msg.Host))
+			}
+		})
+	}
+}
+
+//Writes data to port on host from the local IP. Returns false if it could not be sent
+func sendUDP(host string, port int, data []byte) bool {
 	localip, _, _ := net.ParseCIDR(currHost)
 	LocalAddr, err := net.ResolveUDPAddr("udp", localip.String()+":0")
 	errorCheck(err)
 
-	for _, host := range targetHosts {
-		if msg.Status == "Adios" || msg.Status == "Failed" {
-			fmt.Print("Propagating ")
-			fmt.Print(msg)
-			fmt.Print(" to :")
-			fmt.Println(host)
-		}
-
-		ip, _, _ := net.ParseCIDR(host)
-
-		ServerAddr, err := net.ResolveUDPAddr("udp", ip.String()+":10000")
+	ip, _, _ := net.ParseCIDR(host)
+	ServerAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
 		errorCheck(err)
+		return false
+	}
 
-		conn, err := net.DialUDP("udp", LocalAddr, ServerAddr)
+	conn, err := net.DialUDP("udp", LocalAddr, ServerAddr)
+	if err != nil {
 		errorCheck(err)
-
-		randNum := rand.Intn(100)
-		fmt.Print("Random number = ")
-		fmt.Println(randNum)
-		if !((msg.Status == "SYN" || msg.Status == "ACK" || msg.Status == "Failed" || msg.Status == "Adios") && randNum < PACKET_LOSS) {
-			_, err = conn.Write(buf.Bytes())
-			errorCheck(err)
-		} else {
-			packets_lost++
-			fmt.Print(packets_lost)
-			fmt.Print(" Message failed to send becaue of packet loss: ")
-			fmt.Println(msg)
-		}
+		return false
 	}
-}
+	defer conn.Close()
 
-//VM's ping the next 2 members in the membershipList for an ACK
-func sendSyn() {
-	for {
-		N := len(membershipList)
-		if N >= MIN_HOSTS {
-			msg := message{getIP(), "SYN", time.Now().Format(time.RFC850)}
-			var targetHosts = make([]string, 2)
-			targetHosts[0] = membershipList[(getIndex()+1)%len(membershipList)].Host
-			targetHosts[1] = membershipList[(getIndex()+2)%len(membershipList)].Host
-
-			sendMsg(msg, targetHosts)
-		}
-		time.Sleep(1 * time.Second)
-	}
+	_, err = conn.Write(data)
+	errorCheck(err)
+	return err == nil
 }
 
 //Called when a VM receives a syn. An ack is sent back to the corresponding IP
+//The ack carries our Vivaldi coordinate and the coordinates we know for the rest of the group
 func sendAck(host string) {
-	msg := message{currHost, "ACK", time.Now().Format(time.RFC850)}
+	msg := newMsg(currHost, "ACK")
+	msg.Coord = getLocalCoord()
+	msg.Coords = gossipCoordinates()
 	var targetHosts = make([]string, 1)
 	targetHosts[0] = host
 
 	sendMsg(msg, targetHosts)
 }
 
-//Message sent to introducer from a VM to connect to the group
-func connectToIntroducer() {
-	msg := message{currHost, "Joining", time.Now().Format(time.RFC850)}
-	var targetHosts = make([]string, 1)
-	targetHosts[0] = INTRODUCER
+//Message sent to the seeds (normally just the introducer) from a VM to connect to the group
+func connectToSeeds(seeds []string) {
+	msg := newMsg(currHost, "Joining")
+	msg.Tags = conf().Tags
 
-	sendMsg(msg, targetHosts)
+	sendMsg(msg, seeds)
 }
 
-//Message sent to previous 2 VM's in membershiplist notifying that the VM is leaving the group
-func leaveGroup() {
-	msg := message{currHost, "Adios", time.Now().Format(time.RFC850)}
+//Called when a VM asks a member other than the introducer to join (e.g. a restarted VM rejoining through a
+//member it saw alive). Only the introducer sends membershipLists, so the Joining is passed on to it, if it is
+//in our membershipList, and the introducer adds the VM and sends it the list
+func forwardJoin(msg message) {
+	s := snapshot()
+	if !s.Connected || !s.contains(conf().Introducer) {
+		membershipLog.Info("Ignoring join, the introducer is not in the membershipList", peerAttr(msg.Host))
+		return
+	}
+	membershipLog.Debug("Forwarding join to the introducer", peerAttr(msg.Host))
+	sendMsg(msg, []string{conf().Introducer})
+}
 
-	var targetHosts = make([]string, 2)
-	for i := 1; i < 3; i++ {
-		var targetHostIndex = (getIndex() - i) % len(membershipList)
-		if targetHostIndex < 0 {
-			targetHostIndex = len(membershipList) + targetHostIndex
-		}
-		targetHosts[i-1] = membershipList[targetHostIndex].Host
+//Message sent to every other VM in the membershiplist notifying that the VM is leaving the group.
+//Adios is resent every leave_retry_interval to the VM's that haven't answered with an AdiosACK until all
+//of them have or leave_timeout runs out. Returns true if the previous fanout VM's in the membershiplist, the
+//ones that would otherwise mark this VM as failed, acknowledged the departure
+func leaveGroup() bool {
+	s := snapshot()
+	others := s.others()
+	monitors := s.predecessors(conf().Fanout)
+
+	leaveMutex.Lock()
+	leaveAcks = make(map[string]bool)
+	leaveMutex.Unlock()
+
+	msg := newMsg(currHost, "Adios")
+	deadline := time.Now().Add(conf().LeaveTimeout.Duration)
+	atomic.AddInt64(&inflightPropagations, 1)
+	defer atomic.AddInt64(&inflightPropagations, -1)
+	for pending := others; len(pending) > 0 && time.Now().Before(deadline); pending = pendingLeaveAcks(others) {
+		sendMsg(msg, pending)
+		time.Sleep(conf().LeaveRetryInterval.Duration)
 	}
 
-	sendMsg(msg, targetHosts)
+	unconfirmed := pendingLeaveAcks(monitors)
+	for _, host := range unconfirmed {
+		membershipLog.Warn("No AdiosACK before leave_timeout", peerAttr(host))
+	}
+	return len(unconfirmed) == 0
 }
 
-//Response from VM's to the introducer in response to isAlive. Sent to indicate to the INTRODUCER
-//that the VM is still connected to the group so the INRODUCER doesn't delete it from its membershiplist
-func yup() {
-	msg := message{currHost, "yup", time.Now().Format(time.RFC850)}
+//Sent back to a VM that is leaving the group to confirm its Adios was received
+func sendAdiosAck(host string) {
+	msg := newMsg(currHost, "AdiosACK")
 	var targetHosts = make([]string, 1)
-	targetHosts[0] = INTRODUCER
+	targetHosts[0] = host
 
 	sendMsg(msg, targetHosts)
-
 }
 
 //Called when messages (such as when a member leaves or fails) needs to be propagated to the rest
-//of the group. Messages are propagated to the next two members in the membershipList
+//of the group. Messages are propagated to the next fanout members in the membershipList
 //If the member is not in the local membershipList then the message is ignored (this would happen
-//when a VM has already received a message and made the changes)
+//when a VM has already received a message and made the changes). Messages about an older incarnation
+//of the member (it has left and joined again since) and about the local VM itself are ignored too.
+//Older builds send no incarnation (0), which is treated as unknown rather than older
 //If the member is in the membershipList, updateML is called to compare the timestamps and updates the
-//membershipList is necessary.
-//The message is then propagated to the next two VM's in the membershipList
-func propagateMsg(msg message) {
-	var hostIndex = -1
-	for i, element := range membershipList {
-		if msg.Host == element.Host {
-			hostIndex = i
-			break
-		}
-	}
-	if hostIndex == -1 {
-		return
+//membershipList is necessary. Only a change of the membershipList is logged, journaled and
+//propagated to the next fanout VM's in the membershipList. Returns true if the membershipList changed
+func propagateMsg(msg message) bool {
+	var targetHosts []string
+	var updated bool
+	updateState(func(s *groupState) bool {
+		targetHosts, updated = applyMsg(s, msg)
+		return updated
+	})
+	if updated {
+		msgCheck(msg)
 	}
 
-	msgCheck(msg)
-	updateML(hostIndex, msg)
+	if targetHosts != nil {
+		atomic.AddInt64(&inflightPropagations, 1)
+		sendMsg(msg, targetHosts)
+		atomic.AddInt64(&inflightPropagations, -1)
+	}
+	return updated
+}
 
-	var targetHosts = make([]string, 2)
-	targetHosts[0] = membershipList[(getIndex()+1)%len(membershipList)].Host
-	targetHosts[1] = membershipList[(getIndex()+2)%len(membershipList)].Host
+//Applies a Failed or Adios message to the membershipList as described for propagateMsg. Returns the members
+//to pass it on to, nil if the message is ignored or did not change the membershipList, and true if the
+//membershipList changed. Must be called from updateState
+func applyMsg(s *groupState, msg message) ([]string, bool) {
+	hostIndex := s.indexOf(msg.Host)
+	if hostIndex == -1 {
+		return nil, false
+	}
+	if msg.Host == currHost {
+		membershipLog.Info("Ignoring message about the local VM", typeAttr(msg.Status), incarnationAttr(msg.Incarnation))
+		if msg.Status == "Failed" {
+			atomic.AddUint64(&failedAboutSelf, 1)
+		}
+		return nil, false
+	}
+	if msg.Incarnation != 0 && msg.Incarnation < s.Members[hostIndex].Incarnation {
+		membershipLog.Info("Ignoring message about an older incarnation", typeAttr(msg.Status), peerAttr(msg.Host), incarnationAttr(msg.Incarnation))
+		return nil, false
+	}
 
-	sendMsg(msg, targetHosts)
+	removed := s.Members[hostIndex]
+	if updateML(s, hostIndex, msg) != 1 {
+		return nil, false
+	}
+	if msg.Status == "Failed" {
+		s.markDeparted(removed)
+	}
+	return s.successors(conf().Fanout), true
 }
 
 //Called by introducer if a new member joins group. Sends a membershipList to each member in membershipList
 func sendList() {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(membershipList); err != nil {
-		errorCheck(err)
+	s := snapshot()
+	data, err := encodeList(s.Members)
+	errorCheck(err)
+	for _, host := range s.others() {
+		host := host
+		injectFaults(host, "MembershipList", func() {
+			if sendUDP(host, conf().ListPort, data) {
+				msgsSent.inc("MembershipList")
+			}
+		})
 	}
-	for index, element := range membershipList {
-		if element.Host != currHost {
-			ip, _, _ := net.ParseCIDR(membershipList[index].Host)
-
-			ServerAddr, err := net.ResolveUDPAddr("udp", ip.String()+":10001")
-			errorCheck(err)
-
-			localip, _, _ := net.ParseCIDR(currHost)
-			LocalAddr, err := net.ResolveUDPAddr("udp", localip.String()+":0")
-			errorCheck(err)
-
-			conn, err := net.DialUDP("udp", LocalAddr, ServerAddr)
-			errorCheck(err)
+}
 
-			_, err = conn.Write(buf.Bytes())
-			errorCheck(err)
-		}
+//Message sent to the seeds when the local metadata tags change so the introducer can update the membershipList.
+//Not sent while the group operates at version 1, which does not carry tags
+func sendTags(tags map[string]string) {
+	if messageVersion() < 2 {
+		membershipLog.Debug("Not announcing tags, the group operates at protocol version 1")
+		return
 	}
+	msg := newMsg(currHost, "Tags")
+	msg.Tags = tags
+
+	sendMsg(msg, conf().joinSeeds())
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//A set of counters keyed by a single label value (e.g. message type)
+type counterVec struct {
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+//A cumulative histogram with fixed upper bounds, in the Prometheus style
+type histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+//Counters exported on /metrics
+var msgsSent = newCounterVec()
+var msgsReceived = newCounterVec()
+var msgsDropped = newCounterVec()
+var decodeErrors uint64
+var probesSent uint64
+var ackTimeouts uint64
+var failuresDetected uint64
+var partitionMerges uint64
+
+//Failed messages about the local VM, which it ignores since it is alive
+var failedAboutSelf uint64
+
+//Adios and Failed sends this VM has in progress, a gauge
+var inflightPropagations int64
+
+//RTT of SYN/ACK probes in seconds
+var probeRTT = newHistogram([]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5})
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]uint64)}
+}
+
+func (c *counterVec) inc(label string) {
+	c.mutex.Lock()
+	c.values[label]++
+	c.mutex.Unlock()
+}
+
+//Returns a copy of the counters so they can be written without holding the lock
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	for label, value := range c.values {
+		values[label] = value
+	}
+	return values
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.mutex.Lock()
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+	h.mutex.Unlock()
+}
+
+//Escapes a label value as required by the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//Writes the HELP and TYPE lines for a metric
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+//Writes every value of a counterVec as name{label="value"} sorted by label value
+func writeCounterVec(w io.Writer, name string, label string, help string, c *counterVec) {
+	writeHeader(w, name, "counter", help)
+	values := c.snapshot()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(key), values[key])
+	}
+}
+
+func writeCounter(w io.Writer, name string, help string, value *uint64) {
+	writeHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, atomic.LoadUint64(value))
+}
+
+func writeHistogram(w io.Writer, name string, help string, h *histogram) {
+	writeHeader(w, name, "histogram", help)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+//Handler for /metrics. Writes every metric in the Prometheus text exposition format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeCounterVec(w, "swim_messages_sent_total", "type", "Messages sent by type.", msgsSent)
+	writeCounterVec(w, "swim_messages_received_total", "type", "Messages received by type.", msgsReceived)
+	writeCounterVec(w, "swim_messages_dropped_total", "type", "Messages dropped by simulated packet loss, by type.", msgsDropped)
+	writeCounterVec(w, "swim_foreign_messages_total", "type", "Messages and membership lists from other clusters that were dropped, by type.", foreignMsgs)
+	writeCounter(w, "swim_decode_errors_total", "Packets that could not be decoded.", &decodeErrors)
+	writeCounter(w, "swim_probes_total", "SYN probes sent.", &probesSent)
+	writeCounter(w, "swim_ack_timeouts_total", "Probes that did not get an ACK within ack_timeout.", &ackTimeouts)
+	writeCounter(w, "swim_failures_detected_total", "Members this VM marked as failed.", &failuresDetected)
+	writeCounter(w, "swim_partition_merges_total", "Membership lists of a split group merged by the introducer.", &partitionMerges)
+	writeCounter(w, "swim_failed_about_self_total", "Failed messages about the local VM that were ignored.", &failedAboutSelf)
+
+	members := membersByState()
+	writeHeader(w, "swim_members", "gauge", "Members by state: alive in the membership list, failed or left as last seen by this VM.")
+	for _, state := range []string{STATE_ALIVE, STATE_FAILED, STATE_LEFT} {
+		fmt.Fprintf(w, "swim_members{state=\"%s\"} %d\n", state, members[state])
+	}
+
+	writeHeader(w, "swim_inflight_propagations", "gauge", "Adios and Failed sends this VM has in progress.")
+	fmt.Fprintf(w, "swim_inflight_propagations %d\n", atomic.LoadInt64(&inflightPropagations))
+
+	writeHeader(w, "swim_pending_probes", "gauge", "Probes waiting for an ACK.")
+	fmt.Fprintf(w, "swim_pending_probes %d\n", atomic.LoadInt64(&pendingProbes))
+
+	writeHeader(w, "swim_protocol_version", "gauge", "Protocol version of the last membership list sent or received.")
+	fmt.Fprintf(w, "swim_protocol_version %d\n", atomic.LoadInt64(&protocolVersion))
+
+	writeHistogram(w, "swim_probe_rtt_seconds", "RTT of SYN/ACK probes.", probeRTT)
+}
+
+//Returns the number of members in each state. Alive members are the ones in the membershipList, failed
+//ones are still sent reconnect probes or were last journaled as failed, and left ones were last journaled
+//as left. Members that joined again are only counted as alive
+func membersByState() map[string]int {
+	s := snapshot()
+	states := make(map[string]string)
+	for host, state := range lastStates() {
+		if !s.contains(host) {
+			states[host] = state
+		}
+	}
+	for host := range s.Departed {
+		states[host] = STATE_FAILED
+	}
+	members := map[string]int{STATE_ALIVE: len(s.Members), STATE_FAILED: 0, STATE_LEFT: 0}
+	for _, state := range states {
+		if state != STATE_ALIVE {
+			members[state]++
+		}
+	}
+	return members
+}
+
+//Returns the current value of every metric, for swimctl stats
+func getStats() map[string]interface{} {
+	members := membersByState()
+
+	probeRTT.mutex.Lock()
+	rtt := map[string]interface{}{"count": probeRTT.count, "sum": probeRTT.sum}
+	probeRTT.mutex.Unlock()
+
+	return map[string]interface{}{
+		"messages_sent":         msgsSent.snapshot(),
+		"messages_received":     msgsReceived.snapshot(),
+		"messages_dropped":      msgsDropped.snapshot(),
+		"foreign_messages":      foreignMsgs.snapshot(),
+		"decode_errors":         atomic.LoadUint64(&decodeErrors),
+		"probes":                atomic.LoadUint64(&probesSent),
+		"ack_timeouts":          atomic.LoadUint64(&ackTimeouts),
+		"pending_probes":        atomic.LoadInt64(&pendingProbes),
+		"failures_detected":     atomic.LoadUint64(&failuresDetected),
+		"partition_merges":      atomic.LoadUint64(&partitionMerges),
+		"failed_about_self":     atomic.LoadUint64(&failedAboutSelf),
+		"inflight_propagations": atomic.LoadInt64(&inflightPropagations),
+		"members":               members,
+		"protocol_version":      atomic.LoadInt64(&protocolVersion),
+		"probe_rtt_seconds":     rtt,
+	}
+}
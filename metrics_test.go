@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+//Failed and left members are counted from the departed members and the last journaled states
+func TestMembersByState(t *testing.T) {
+	setMembers(t, 2, 3, 4, 5)
+	for _, i := range []int{2, 3, 4, 5} {
+		recordEvent(testHost(i), "joined", 1, currHost)
+	}
+
+	msg := newMsg(testHost(2), "Failed")
+	msg.Incarnation = 1
+	propagateMsg(msg)
+	msg = newMsg(testHost(3), "Adios")
+	msg.Incarnation = 1
+	propagateMsg(msg)
+
+	members := membersByState()
+	if members[STATE_ALIVE] != 3 || members[STATE_FAILED] != 1 || members[STATE_LEFT] != 1 {
+		t.Fatalf("members by state = %v", members)
+	}
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`swim_members{state="alive"} 3`, `swim_members{state="failed"} 1`, `swim_members{state="left"} 1`, "swim_inflight_propagations 0"} {
+		if !strings.Contains(recorder.Body.String(), line+"\n") {
+			t.Errorf("/metrics has no %q", line)
+		}
+	}
+}
+
+//A Failed message about the local VM is ignored and counted
+func TestFailedAboutSelf(t *testing.T) {
+	setMembers(t, 2)
+	before := atomic.LoadUint64(&failedAboutSelf)
+	propagateMsg(newMsg(currHost, "Failed"))
+	if !snapshot().contains(currHost) {
+		t.Fatalf("local VM removed by a Failed about itself")
+	}
+	if atomic.LoadUint64(&failedAboutSelf) != before+1 {
+		t.Fatalf("Failed about the local VM not counted")
+	}
+}
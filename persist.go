@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Name of the file in data_dir holding the member table
+const STATE_FILE = "members.json"
+
+//Name of the file in data_dir locked by the running node. Holds the PID and start time of its owner
+const LOCK_FILE = "LOCK"
+
+//Exit status when data_dir is locked by another node
+const EXIT_DATA_DIR_LOCKED = 4
+
+//Version of the state file format
+const STATE_VERSION = 1
+
+//State file as written to disk. Checksum is the SHA-256 of State, so a torn or corrupted file is detected
+//on load instead of silently restoring part of the group
+type stateFile struct {
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
+}
+
+//Member table of this VM: every member of its membershipList (alive) and the members it is still
+//sending reconnect probes to (failed)
+type persistedState struct {
+	Version     int               `json:"version"`
+	Cluster     string            `json:"cluster"`
+	Host        string            `json:"host"`
+	Incarnation int               `json:"incarnation"`
+	Saved       string            `json:"saved"`
+	Members     []persistedMember `json:"members"`
+}
+
+type persistedMember struct {
+	Host        string            `json:"host"`
+	State       string            `json:"state"`
+	TimeStamp   string            `json:"timestamp"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Incarnation int               `json:"incarnation"`
+	MinVersion  int               `json:"min_version,omitempty"`
+	MaxVersion  int               `json:"max_version,omitempty"`
+	//When a failed member was marked as failed
+	Since string `json:"since,omitempty"`
+}
+
+//State loaded at startup, nil if there was none
+var savedState *persistedState
+
+//Wakes up persistLoop. Holds at most one request so bursts of changes are written once
+var persistRequests = make(chan struct{}, 1)
+
+//Mutex held while the state file is written, so there is only ever one writer
+var persistMutex = &sync.Mutex{}
+
+//Contents of the lock file
+type lockOwner struct {
+	PID     int    `json:"pid"`
+	Started string `json:"started"`
+}
+
+//Lock file, kept open (and locked) until the process exits
+var lockFile *os.File
+
+func statePath() string {
+	return filepath.Join(conf().DataDir, STATE_FILE)
+}
+
+//Creates data_dir and takes an exclusive lock on it, so two nodes never share a member table (or a log
+//file, in the same working directory). The lock is released by the kernel when the process exits, even
+//after a crash. Returns an error naming the owner if another node holds it
+func lockDataDir() error {
+	if err := os.MkdirAll(conf().DataDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(conf().DataDir, LOCK_FILE)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return fmt.Errorf("cannot lock %s: %v", path, err)
+		}
+		var owner lockOwner
+		if b, err := io.ReadAll(f); err == nil && json.Unmarshal(b, &owner) == nil {
+			return fmt.Errorf("data_dir %s is in use by another node (pid %d, started %s)", conf().DataDir, owner.PID, owner.Started)
+		}
+		return fmt.Errorf("data_dir %s is in use by another node", conf().DataDir)
+	}
+
+	b, err := json.Marshal(lockOwner{os.Getpid(), time.Now().Format(time.RFC3339Nano)})
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt(append(b, '\n'), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lockFile = f
+	return nil
+}
+
+//Imports the legacy membership_file if there is no state file yet, loads the state and starts the
+//writer. Returns the incarnation to start with: a VM restarting from its state comes back with the next
+//incarnation, so the group tells it apart from its previous self
+func initializePersistence() int {
+	incarnation := 1
+	if _, err := os.Stat(statePath()); os.IsNotExist(err) {
+		migrateMembershipFile()
+	}
+	state, err := loadState()
+	if err != nil && !os.IsNotExist(err) {
+		recoveryLog.Error("Ignoring unreadable state file", slog.String("file", statePath()), slog.String("error", err.Error()))
+		if err := os.Rename(statePath(), statePath()+".corrupt"); err != nil {
+			errorCheck(err)
+		}
+	}
+	if state != nil {
+		savedState = state
+		if state.Host == currHost && state.Incarnation >= incarnation {
+			incarnation = state.Incarnation + 1
+		}
+		recoveryLog.Info("Loaded state", slog.String("file", statePath()), slog.Int("members", len(state.Members)), slog.String("saved", state.Saved))
+	}
+	go persistLoop()
+	return incarnation
+}
+
+//Reads and verifies the state file
+func loadState() (*persistedState, error) {
+	b, err := os.ReadFile(statePath())
+	if err != nil {
+		return nil, err
+	}
+	var f stateFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(f.State)
+	if f.Checksum != hex.EncodeToString(sum[:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	var state persistedState
+	if err := json.Unmarshal(f.State, &state); err != nil {
+		return nil, err
+	}
+	if state.Version != STATE_VERSION {
+		return nil, fmt.Errorf("unsupported version %d", state.Version)
+	}
+	return &state, nil
+}
+
+//Asks the writer to save the member table. Never blocks, so it can be called from updateState
+func persistState() {
+	select {
+	case persistRequests <- struct{}{}:
+	default:
+	}
+}
+
+//Writes the member table every time persistState is called
+func persistLoop() {
+	for range persistRequests {
+		errorCheck(saveState())
+	}
+}
+
+//Writes the member table to a temporary file, syncs it and renames it over the state file, so a crash
+//leaves either the old or the new state on disk
+func saveState() error {
+	persistMutex.Lock()
+	defer persistMutex.Unlock()
+
+	state := persistedState{Version: STATE_VERSION, Cluster: conf().ClusterName, Host: currHost, Saved: time.Now().Format(time.RFC3339Nano)}
+	s := snapshot()
+	state.Incarnation = s.Incarnation
+	for _, element := range s.Members {
+		state.Members = append(state.Members, persistedMember{Host: element.Host, State: STATE_ALIVE, TimeStamp: element.TimeStamp,
+			Tags: element.Tags, Incarnation: element.Incarnation, MinVersion: element.MinVersion, MaxVersion: element.MaxVersion})
+	}
+	for _, d := range s.Departed {
+		state.Members = append(state.Members, persistedMember{Host: d.member.Host, State: STATE_FAILED, TimeStamp: d.member.TimeStamp,
+			Tags: d.member.Tags, Incarnation: d.member.Incarnation, MinVersion: d.member.MinVersion, MaxVersion: d.member.MaxVersion,
+			Since: d.failed.Format(time.RFC3339Nano)})
+	}
+
+	b, err := encodeState(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath(), b)
+}
+
+//Returns the contents of the state file for state
+func encodeState(state persistedState) ([]byte, error) {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return json.Marshal(stateFile{hex.EncodeToString(sum[:]), raw})
+}
+
+//Replaces path with data: writes a temporary file next to it, syncs it, renames it over path and syncs
+//the directory so the rename itself survives a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+//Adds the members of savedState other than the local VM back to the membershipList, and the failed
+//ones to the members sent reconnect probes. Used by the introducer when it restarts, from updateState
+func restoreMembers(s *groupState) {
+	if savedState == nil {
+		return
+	}
+	for _, m := range savedState.Members {
+		if m.Host == currHost {
+			continue
+		}
+		node := member{Host: m.Host, TimeStamp: m.TimeStamp, Tags: m.Tags, Incarnation: m.Incarnation, MinVersion: m.MinVersion, MaxVersion: m.MaxVersion}
+		switch m.State {
+		case STATE_ALIVE:
+			s.Members = append(s.Members, node)
+		case STATE_FAILED:
+			if since, err := time.Parse(time.RFC3339Nano, m.Since); err == nil {
+				s.Departed[m.Host] = departedMember{node, since}
+			}
+		}
+	}
+	sort.Sort(memList(s.Members))
+}
+
+//Returns true if savedState has members other than the local VM
+func hasSavedMembers() bool {
+	if savedState == nil {
+		return false
+	}
+	for _, m := range savedState.Members {
+		if m.Host != currHost {
+			return true
+		}
+	}
+	return false
+}
+
+//Imports the host names in membership_file, written by older builds, into the state file and renames
+//membership_file so it is only imported once
+func migrateMembershipFile() {
+	file, err := os.Open(conf().MembershipFile)
+	if err != nil {
+		return
+	}
+	currTime := time.Now().Format(time.RFC850)
+	state := persistedState{Version: STATE_VERSION, Cluster: conf().ClusterName, Host: currHost, Incarnation: 1, Saved: time.Now().Format(time.RFC3339Nano)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			state.Members = append(state.Members, persistedMember{Host: scanner.Text(), State: STATE_ALIVE, TimeStamp: currTime})
+		}
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		errorCheck(err)
+		return
+	}
+
+	b, err := encodeState(state)
+	if err == nil {
+		err = writeFileAtomic(statePath(), b)
+	}
+	if err == nil {
+		err = os.Rename(conf().MembershipFile, conf().MembershipFile+".migrated")
+	}
+	if err != nil {
+		errorCheck(err)
+		return
+	}
+	recoveryLog.Info("Imported membership file", slog.String("file", conf().MembershipFile), slog.Int("members", len(state.Members)))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+//SYN sent to a member that has not been answered yet. Any ACK from the member answers it, the SYN's
+//resent every probe_interval while it is outstanding are retransmissions of the same probe
+type probe struct {
+	//Incarnation of the member when the probe was sent. A member that rejoined since is not failed for it
+	incarnation int
+	//The member is marked as failed if no ACK arrives before deadline (sent + ack_timeout)
+	deadline time.Time
+}
+
+//Outstanding probes by host. Owned by stateLoop like the groupState, only touched from functions passed
+//to updateState
+var probes = make(map[string]*probe)
+
+//Number of outstanding probes after the last pass of the scheduler, for metrics
+var pendingProbes int64
+
+//Returns the members monitored by the local VM: the next fanout members in the membershipList, or every
+//other member in a group of fanout members or less
+func (s *groupState) monitored() []string {
+	return s.successors(conf().Fanout)
+}
+
+//Probe scheduler. Every probe_interval, sends a SYN to each monitored member and starts a probe for the
+//ones that have none outstanding. Probes have their own deadlines and are only dropped when answered or
+//when their member is no longer in the membershipList, so a membership change (e.g. a join moving the
+//successors) does not discard a probe in flight: a member that stops answering is failed by the probe
+//it was sent even if it is no longer monitored, and is sent SYN's until then like a monitored one. A
+//probe that reaches its deadline marks its member as failed and the failure is propagated to the group
+func probeLoop() {
+	nextSyn := time.Now()
+	for !isStopping() {
+		var targets []string
+		var failed []message
+		var wake time.Time
+		round := false
+		updateState(func(s *groupState) bool {
+			now := time.Now()
+			failed = expireProbes(s, now)
+			if !now.Before(nextSyn) {
+				round = true
+				nextSyn = now.Add(conf().ProbeInterval.Duration)
+				if len(s.Members) >= conf().MinHosts {
+					targets = startProbes(s, now)
+				}
+			}
+			wake = nextSyn
+			for _, p := range probes {
+				if p.deadline.Before(wake) {
+					wake = p.deadline
+				}
+			}
+			atomic.StoreInt64(&pendingProbes, int64(len(probes)))
+			return false
+		})
+
+		for _, msg := range failed {
+			probeLog.Warn("Failure detected", peerAttr(msg.Host), incarnationAttr(msg.Incarnation), slog.Duration("ack_timeout", conf().AckTimeout.Duration))
+			atomic.AddUint64(&failuresDetected, 1)
+			propagateMsg(msg)
+		}
+		if round {
+			pruneCoordinates()
+		}
+		if len(targets) > 0 {
+			msg := newMsg(getIP(), "SYN")
+			msg.Coord = getLocalCoord()
+			for _, host := range targets {
+				recordSyn(host)
+			}
+			atomic.AddUint64(&probesSent, uint64(len(targets)))
+			sendMsg(msg, targets)
+		}
+		time.Sleep(time.Until(wake))
+	}
+}
+
+//Starts a probe for each monitored member that has none outstanding and returns the members to send a
+//SYN to: the monitored ones and the ones with a probe still outstanding, whose SYN or ACK may have been
+//lost. Must be called from updateState
+func startProbes(s *groupState, now time.Time) []string {
+	targets := s.monitored()
+	for _, host := range targets {
+		if _, ok := probes[host]; !ok {
+			probes[host] = &probe{incarnation: s.Members[s.indexOf(host)].Incarnation, deadline: now.Add(conf().AckTimeout.Duration)}
+		}
+	}
+	for host := range probes {
+		if !containsString(targets, host) {
+			targets = append(targets, host)
+		}
+	}
+	return targets
+}
+
+//Drops the probes that reached their deadline and returns a Failed message for each one whose member
+//is still in the membershipList with the incarnation it was probed at. Must be called from updateState
+func expireProbes(s *groupState, now time.Time) []message {
+	var failed []message
+	for host, p := range probes {
+		i := s.indexOf(host)
+		if i == -1 || s.Members[i].Incarnation != p.incarnation {
+			//Left, failed or rejoined since the probe was sent
+			delete(probes, host)
+			continue
+		}
+		if now.Before(p.deadline) {
+			continue
+		}
+		delete(probes, host)
+		atomic.AddUint64(&ackTimeouts, 1)
+		if isStopping() {
+			continue
+		}
+		msg := newMsg(host, "Failed")
+		msg.Incarnation = p.incarnation
+		failed = append(failed, msg)
+	}
+	return failed
+}
+
+//Called when an ACK is received. Answers the outstanding probe of the sender, if any
+func answerProbe(host string) {
+	updateState(func(s *groupState) bool {
+		delete(probes, host)
+		return false
+	})
+}
+
+//Drops every outstanding probe, used when the VM leaves the group. Must be called from updateState
+func clearProbes() {
+	probes = make(map[string]*probe)
+}
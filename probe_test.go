@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+//A simulated group. Every VM has its own membershipList and runs the node's own code for failure
+//detection and propagation, with currHost switched to it
+type simGroup struct {
+	//Hosts in membershipList order
+	hosts  []string
+	states map[string]*groupState
+	down   map[string]bool
+}
+
+func newSimGroup(n int) *simGroup {
+	g := &simGroup{states: make(map[string]*groupState), down: make(map[string]bool)}
+	for _, element := range testGroup(n).Members {
+		g.hosts = append(g.hosts, element.Host)
+		g.states[element.Host] = testGroup(n)
+	}
+	return g
+}
+
+//Crashes the k adjacent members starting at position first of the membershipList, wrapping around
+func (g *simGroup) crash(first int, k int) []string {
+	var crashed []string
+	for i := 0; i < k; i++ {
+		host := g.hosts[(first+i)%len(g.hosts)]
+		g.down[host] = true
+		crashed = append(crashed, host)
+	}
+	return crashed
+}
+
+//Every live VM fails the members it monitors that are down, as its probes would after ack_timeout,
+//and the Failed messages are passed on until no live VM forwards them anymore
+func (g *simGroup) detect() {
+	type delivery struct {
+		to  string
+		msg message
+	}
+	var queue []delivery
+	for _, host := range g.hosts {
+		if g.down[host] {
+			continue
+		}
+		asHost(host, func() {
+			for _, target := range g.states[host].monitored() {
+				if g.down[target] {
+					msg := newMsg(target, "Failed")
+					msg.Incarnation = 1
+					queue = append(queue, delivery{host, msg})
+				}
+			}
+		})
+	}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		asHost(d.to, func() {
+			targets, _ := applyMsg(g.states[d.to], d.msg)
+			for _, target := range targets {
+				if !g.down[target] {
+					queue = append(queue, delivery{target, d.msg})
+				}
+			}
+		})
+	}
+}
+
+//Returns the live VM's that still have host in their membershipList
+func (g *simGroup) stillListing(host string) []string {
+	var hosts []string
+	for _, h := range g.hosts {
+		if !g.down[h] && g.states[h].contains(host) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+//Runs fn for every group size in sizes and fanout 1-3, with the fanout set in the config
+func forFanouts(t *testing.T, sizes func(fanout int) []int, fn func(t *testing.T, n int, fanout int)) {
+	defer setConfig(func(c *config) { c.Fanout = defaultConfig().Fanout })
+	for fanout := 1; fanout <= 3; fanout++ {
+		setConfig(func(c *config) { c.Fanout = fanout })
+		for _, n := range sizes(fanout) {
+			t.Run(fmt.Sprintf("N=%d/fanout=%d", n, fanout), func(t *testing.T) { fn(t, n, fanout) })
+		}
+	}
+}
+
+//Up to fanout adjacent members crashing at the same time are detected and every live VM removes them,
+//wherever they are in the membershipList
+func TestAdjacentFailuresUpToFanout(t *testing.T) {
+	sizes := func(fanout int) []int { return []int{fanout + 1, fanout + 3, 8, 12} }
+	forFanouts(t, sizes, func(t *testing.T, n int, fanout int) {
+		for k := 1; k <= min(fanout, n-1); k++ {
+			for first := 0; first < n; first++ {
+				g := newSimGroup(n)
+				crashed := g.crash(first, k)
+				g.detect()
+				for _, host := range crashed {
+					if listing := g.stillListing(host); len(listing) > 0 {
+						t.Errorf("k=%d from %d: %s still listed by %v", k, first, host, listing)
+					}
+				}
+			}
+		}
+	})
+}
+
+//fanout+1 adjacent crashes are the documented limit: the last of them is monitored only by members
+//that crashed with it, so it is never detected
+func TestAdjacentFailuresBeyondFanout(t *testing.T) {
+	sizes := func(fanout int) []int { return []int{fanout + 3, 12} }
+	forFanouts(t, sizes, func(t *testing.T, n int, fanout int) {
+		for first := 0; first < n; first++ {
+			g := newSimGroup(n)
+			crashed := g.crash(first, fanout+1)
+			g.detect()
+			last := crashed[len(crashed)-1]
+			if listing := g.stillListing(last); len(listing) != n-fanout-1 {
+				t.Errorf("from %d: %s removed by some live VM, still listed by %v", first, last, listing)
+			}
+		}
+	})
+}
+
+//Hosts the Failed messages are about
+func failedHosts(failed []message) []string {
+	hosts := make([]string, 0, len(failed))
+	for _, msg := range failed {
+		hosts = append(hosts, msg.Host)
+	}
+	return hosts
+}
+
+//A probe fails its member ack_timeout after it started, and the SYN's resent every probe_interval until
+//then do not restart it
+func TestProbeExpiresAtItsDeadline(t *testing.T) {
+	setMembers(t, 3, 5)
+	interval, timeout := conf().ProbeInterval.Duration, conf().AckTimeout.Duration
+	start := time.Now()
+	updateState(func(s *groupState) bool {
+		for now := start; now.Before(start.Add(timeout)); now = now.Add(interval) {
+			if targets := startProbes(s, now); !sameStrings(targets, s.monitored()) {
+				t.Errorf("SYN's sent to %v, want %v", targets, s.monitored())
+			}
+		}
+		if failed := expireProbes(s, start.Add(timeout-time.Millisecond)); len(failed) > 0 {
+			t.Errorf("%v failed before ack_timeout", failedHosts(failed))
+		}
+		failed := expireProbes(s, start.Add(timeout))
+		if !sameStrings(failedHosts(failed), []string{testHost(3), testHost(5)}) {
+			t.Errorf("failed %v at ack_timeout, want %v and %v", failedHosts(failed), testHost(3), testHost(5))
+		}
+		for _, msg := range failed {
+			if msg.Incarnation != 1 {
+				t.Errorf("Failed about %s carries incarnation %d, want 1", msg.Host, msg.Incarnation)
+			}
+		}
+		if len(probes) > 0 {
+			t.Errorf("probes still outstanding after they expired: %v", probes)
+		}
+		return false
+	})
+}
+
+//A join that moves the successors keeps the probe of the member no longer monitored, which is still sent
+//SYN's and fails it at its own deadline
+func TestProbeSurvivesJoin(t *testing.T) {
+	setMembers(t, 3, 5)
+	interval, timeout := conf().ProbeInterval.Duration, conf().AckTimeout.Duration
+	start := time.Now()
+	updateState(func(s *groupState) bool {
+		startProbes(s, start)
+		return false
+	})
+	updateState(func(s *groupState) bool {
+		return addMember(s, testMember(2, 1))
+	})
+	updateState(func(s *groupState) bool {
+		if containsString(s.monitored(), testHost(5)) {
+			t.Fatalf("%s still monitored after the join: %v", testHost(5), s.monitored())
+		}
+		if failed := expireProbes(s, start.Add(interval)); len(failed) > 0 {
+			t.Errorf("%v failed before ack_timeout", failedHosts(failed))
+		}
+		targets := startProbes(s, start.Add(interval))
+		if !sameStrings(targets, []string{testHost(2), testHost(3), testHost(5)}) {
+			t.Errorf("SYN's sent to %v after the join, want the monitored members and %s", targets, testHost(5))
+		}
+		failed := expireProbes(s, start.Add(timeout))
+		if !sameStrings(failedHosts(failed), []string{testHost(3), testHost(5)}) {
+			t.Errorf("failed %v at the first probes' deadline, want %v and %v", failedHosts(failed), testHost(3), testHost(5))
+		}
+		return false
+	})
+}
+
+//A probe is dropped without failing its member once the member leaves or rejoins with a new incarnation
+func TestProbeDroppedForLeftOrRejoinedMember(t *testing.T) {
+	setMembers(t, 3, 5)
+	start := time.Now()
+	updateState(func(s *groupState) bool {
+		startProbes(s, start)
+		s.Members = slices.DeleteFunc(s.Members, func(m member) bool { return m.Host == testHost(3) })
+		s.Members[s.indexOf(testHost(5))].Incarnation = 2
+		if failed := expireProbes(s, start); len(failed) > 0 {
+			t.Errorf("%v failed after leaving or rejoining", failedHosts(failed))
+		}
+		if len(probes) > 0 {
+			t.Errorf("probes kept for members that left or rejoined: %v", probes)
+		}
+		return true
+	})
+}
+
+//An ACK answers the probe of its sender and no other
+func TestAnswerProbe(t *testing.T) {
+	setMembers(t, 3, 5)
+	updateState(func(s *groupState) bool {
+		startProbes(s, time.Now())
+		return false
+	})
+	answerProbe(testHost(3))
+	updateState(func(s *groupState) bool {
+		if _, ok := probes[testHost(3)]; ok {
+			t.Errorf("probe of %s kept after its ACK", testHost(3))
+		}
+		if _, ok := probes[testHost(5)]; !ok {
+			t.Errorf("ACK from %s answered the probe of %s", testHost(3), testHost(5))
+		}
+		return false
+	})
+}
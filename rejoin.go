@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+)
+
+//Returns the members a restarted VM tries to rejoin through: the introducer if it was a member, then
+//the configured seeds, then every other member it saw alive before it stopped. Empty if the VM was not
+//part of a group when its state was saved (it never joined or it left)
+func rejoinPeers() []string {
+	if savedState == nil || savedState.Host != currHost || savedState.Cluster != conf().ClusterName {
+		return nil
+	}
+	alive := make([]string, 0, len(savedState.Members))
+	for _, m := range savedState.Members {
+		if m.State == STATE_ALIVE && m.Host != currHost {
+			alive = append(alive, m.Host)
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+
+	peers := make([]string, 0, len(alive)+1)
+	if containsString(alive, conf().Introducer) {
+		peers = append(peers, conf().Introducer)
+	}
+	for _, seed := range conf().joinSeeds() {
+		if seed != currHost && !containsString(peers, seed) {
+			peers = append(peers, seed)
+		}
+	}
+	for _, host := range alive {
+		if !containsString(peers, host) {
+			peers = append(peers, host)
+		}
+	}
+	return peers
+}
+
+//Rejoins the group a VM was part of before it restarted, trying one peer at a time until one of them
+//sends a membershipList. The incarnation was bumped when the state was loaded, so the group replaces
+//the entry of our previous self (which may have been marked as failed) instead of ignoring the join
+func autoRejoin() {
+	peers := rejoinPeers()
+	if !conf().AutoRejoin || len(peers) == 0 || currHost == conf().Introducer {
+		return
+	}
+	membershipLog.Info("Rejoining group from saved state", slog.Any("peers", peers), incarnationAttr(snapshot().Incarnation))
+	for _, peer := range peers {
+		switch err := joinGroup([]string{peer}); err {
+		case nil:
+			membershipLog.Info("Rejoined group", peerAttr(peer), incarnationAttr(snapshot().Incarnation))
+			return
+		case errAlreadyConnected:
+			//Joined through swimctl or the admin API in the meantime
+			return
+		case errJoinTimeout:
+			membershipLog.Debug("No answer from peer, trying the next one", peerAttr(peer))
+		default:
+			membershipLog.Error("Could not rejoin group", peerAttr(peer), slog.String("error", err.Error()))
+			return
+		}
+	}
+	membershipLog.Error("Could not rejoin group, no peer answered. Join manually", slog.Any("peers", peers))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+)
+
+//Settings that can be changed without restarting the node, by JSON key, with the function copying the new
+//value into the running config. Everything else is only read at startup
+var reloadable = map[string]func(c *config, next config){
+	"seeds":                func(c *config, next config) { c.Seeds = next.Seeds },
+	"join_timeout":         func(c *config, next config) { c.JoinTimeout = next.JoinTimeout },
+	"probe_interval":       func(c *config, next config) { c.ProbeInterval = next.ProbeInterval },
+	"ack_timeout":          func(c *config, next config) { c.AckTimeout = next.AckTimeout },
+	"fanout":               func(c *config, next config) { c.Fanout = next.Fanout },
+	"faults":               func(c *config, next config) { c.Faults = next.Faults },
+	"query_timeout":        func(c *config, next config) { c.QueryTimeout = next.QueryTimeout },
+	"reconnect_interval":   func(c *config, next config) { c.ReconnectInterval = next.ReconnectInterval },
+	"reconnect_timeout":    func(c *config, next config) { c.ReconnectTimeout = next.ReconnectTimeout },
+	"is_alive_count":       func(c *config, next config) { c.IsAliveCount = next.IsAliveCount },
+	"is_alive_interval":    func(c *config, next config) { c.IsAliveInterval = next.IsAliveInterval },
+	"recovery_wait":        func(c *config, next config) { c.RecoveryWait = next.RecoveryWait },
+	"leave_timeout":        func(c *config, next config) { c.LeaveTimeout = next.LeaveTimeout },
+	"leave_retry_interval": func(c *config, next config) { c.LeaveRetryInterval = next.LeaveRetryInterval },
+	"log_level":            func(c *config, next config) { c.LogLevel = next.LogLevel },
+	"log_levels":           func(c *config, next config) { c.LogLevels = next.LogLevels },
+	"log_max_size":         func(c *config, next config) { c.LogMaxSize = next.LogMaxSize },
+	"log_max_age":          func(c *config, next config) { c.LogMaxAge = next.LogMaxAge },
+	"log_max_backups":      func(c *config, next config) { c.LogMaxBackups = next.LogMaxBackups },
+	"log_compress":         func(c *config, next config) { c.LogCompress = next.LogCompress },
+	"tags":                 func(c *config, next config) { c.Tags = next.Tags },
+}
+
+//Outcome of a reload, reported by the admin API and swimctl
+type reloadResult struct {
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requires_restart"`
+}
+
+//Reloads the config whenever the process receives SIGHUP
+func reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		nodeLog.Info("Reloading config", slog.String("signal", "SIGHUP"))
+		if _, err := reloadConfig(); err != nil {
+			errorCheck(err)
+		}
+	}
+}
+
+//Reads the config file, environment and flags again and applies the settings in reloadable.
+//Other changed settings are logged and keep their current value until the node is restarted.
+//Nothing is applied if the new config is invalid
+func reloadConfig() (reloadResult, error) {
+	result := reloadResult{make([]string, 0), make([]string, 0)}
+
+	next, err := loadConfig()
+	if err != nil {
+		return result, fmt.Errorf("reload: invalid config, keeping the current one: %v", err)
+	}
+
+	cfgMutex.Lock()
+	prev := cfg
+	oldValues := configValues(prev)
+	newValues := configValues(next)
+	keys := make([]string, 0, len(newValues))
+	for key := range newValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	//Start from the running config and only copy over what may change at runtime
+	applied := prev
+	for _, key := range keys {
+		if reflect.DeepEqual(oldValues[key], newValues[key]) {
+			continue
+		}
+		change := fmt.Sprintf("%s: %v -> %v", key, jsonString(oldValues[key]), jsonString(newValues[key]))
+		if apply, ok := reloadable[key]; ok {
+			apply(&applied, next)
+			result.Applied = append(result.Applied, change)
+		} else {
+			result.RequiresRestart = append(result.RequiresRestart, change)
+		}
+	}
+	cfg = applied
+	cfgMutex.Unlock()
+
+	//Timing is picked up by probeLoop the next time it reads the config
+	if applied.LogLevel != prev.LogLevel || !reflect.DeepEqual(applied.LogLevels, prev.LogLevels) {
+		setLogLevels(applied.LogLevel, applied.LogLevels)
+	}
+	if !reflect.DeepEqual(applied.Faults, prev.Faults) {
+		setFaults(applied.Faults)
+	}
+	if !reflect.DeepEqual(applied.Tags, prev.Tags) {
+		announceTags(applied.Tags)
+	}
+
+	for _, change := range result.Applied {
+		nodeLog.Info("Reloaded setting", slog.String("change", change))
+	}
+	for _, change := range result.RequiresRestart {
+		nodeLog.Warn("Setting requires restart, keeping the current value", slog.String("change", change))
+	}
+	if len(result.Applied) == 0 && len(result.RequiresRestart) == 0 {
+		nodeLog.Info("Reloaded config, nothing changed")
+	}
+	return result, nil
+}
+
+//Updates our own entry in the membershipList and lets the group know about new tags
+func announceTags(tags map[string]string) {
+	updateTags(currHost, tags)
+	if currHost == conf().Introducer {
+		sendList()
+	} else if snapshot().Connected {
+		sendTags(tags)
+	}
+}
+
+//Returns the config as a map from JSON key to value so settings can be compared by name
+func configValues(c config) map[string]interface{} {
+	values := make(map[string]interface{})
+	b, err := json.Marshal(c)
+	errorCheck(err)
+	err = json.Unmarshal(b, &values)
+	errorCheck(err)
+	return values
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+//Every reloadable setting copies its own field, and only that one, into the running config
+func TestReloadableSettingsApplied(t *testing.T) {
+	next := defaultConfig()
+	next.Seeds = []string{testHost(2)}
+	next.Faults = faultConfig{Seed: 1}
+	next.LogLevels = map[string]string{"probe": "debug"}
+	next.LogMaxAge = duration{time.Hour}
+	next.LogCompress = true
+	next.Tags = map[string]string{"zone": "a"}
+	nextValues := configValues(next)
+	emptyValues := configValues(config{})
+
+	for key, apply := range reloadable {
+		if _, ok := nextValues[key]; !ok {
+			t.Errorf("reloadable setting %q is not a config key", key)
+			continue
+		}
+		var c config
+		apply(&c, next)
+		for name, value := range configValues(c) {
+			changed := !reflect.DeepEqual(value, emptyValues[name])
+			if name == key && !changed {
+				t.Errorf("reloading %q does not apply it", key)
+			}
+			if name != key && changed {
+				t.Errorf("reloading %q changes %q", key, name)
+			}
+		}
+	}
+}
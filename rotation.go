@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Suffix added to rotated log files, e.g. logfile.log.20060102-150405.000
+const ROTATED_LOG_FORMAT = "20060102-150405.000"
+
+//Log file that is rotated once it grows past log_max_size or gets older than log_max_age.
+//Rotated files are renamed with a timestamp suffix, optionally gzipped, and only the newest
+//log_max_backups are kept. Reads its limits from the config on every write so they can be reloaded.
+//If the file cannot be opened again after a rotation, records go to stderr until it is reopened
+type rotatingFile struct {
+	path string
+	file *os.File
+	size int64
+	//Time of the first record in the file, the file's age is measured from it
+	started time.Time
+	mutex   sync.Mutex
+}
+
+//Only one rotation cleans up old files at a time
+var pruneMutex = &sync.Mutex{}
+
+//Opens path for appending, creating it if needed
+func openRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//Must be called while holding r.mutex
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	r.started = fileStarted(r.path, info)
+	return nil
+}
+
+//Returns the time of the first record of the log file at path, so a file reopened after a restart keeps
+//its age. Falls back to the modification time if the first line has no time, and to now if it is empty
+func fileStarted(path string, info os.FileInfo) time.Time {
+	if info.Size() == 0 {
+		return time.Now()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return info.ModTime()
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(io.LimitReader(f, 64*1024)).ReadString('\n')
+	if value, ok := submatch(logTimeRegexp, line); ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+	return info.ModTime()
+}
+
+//Closes the file unless it is the stderr fallback. Must be called while holding r.mutex
+func (r *rotatingFile) close() {
+	if r.file != os.Stderr {
+		r.file.Close()
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rotated := false
+	if r.needsRotation(len(p)) {
+		if err := r.rotate(); err != nil {
+			//The record is still written, to the same file or to stderr
+			fmt.Fprintln(os.Stderr, "Log rotation failed: "+err.Error())
+		} else {
+			rotated = true
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if rotated {
+		go pruneRotatedLogs(r.path)
+	}
+	return n, err
+}
+
+//Returns true if writing n more bytes would go past log_max_size, or the file is older than log_max_age.
+//An empty file, or stderr, is never rotated
+func (r *rotatingFile) needsRotation(n int) bool {
+	if r.size == 0 || r.file == os.Stderr {
+		return false
+	}
+	c := conf()
+	if c.LogMaxSize > 0 && r.size+int64(n) > int64(c.LogMaxSize)*1024*1024 {
+		return true
+	}
+	return c.LogMaxAge.Duration > 0 && time.Since(r.started) >= c.LogMaxAge.Duration
+}
+
+//Renames the current file with a timestamp suffix and starts a new one. If the rename fails it keeps
+//writing to the same file rather than losing records. Must be called while holding r.mutex
+func (r *rotatingFile) rotate() error {
+	r.close()
+	err := os.Rename(r.path, r.path+"."+time.Now().Format(ROTATED_LOG_FORMAT))
+	if openErr := r.openOrStderr(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+//Opens path again, or switches to stderr if it cannot be opened. Must be called while holding r.mutex
+func (r *rotatingFile) openOrStderr() error {
+	err := r.open()
+	if err != nil {
+		r.file = os.Stderr
+		r.size = 0
+	}
+	return err
+}
+
+//Closes the file and opens path again. Used after an external tool (e.g. logrotate) moved the file away
+func (r *rotatingFile) reopen() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.close()
+	return r.openOrStderr()
+}
+
+//Returns the files path was rotated to: path.<ROTATED_LOG_FORMAT>, optionally gzipped. Other files
+//starting with path (e.g. path.bak) are left alone
+func rotatedLogs(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := make([]string, 0, len(matches))
+	for _, name := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, path+"."), ".gz")
+		if _, err := time.Parse(ROTATED_LOG_FORMAT, suffix); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	return rotated, nil
+}
+
+//Compresses rotated files if log_compress is set and removes all but the newest log_max_backups
+func pruneRotatedLogs(path string) {
+	pruneMutex.Lock()
+	defer pruneMutex.Unlock()
+
+	rotated, err := rotatedLogs(path)
+	if err != nil {
+		errorCheck(err)
+		return
+	}
+	//The timestamp suffix sorts oldest first
+	sort.Strings(rotated)
+
+	if conf().LogCompress {
+		for i, name := range rotated {
+			if strings.HasSuffix(name, ".gz") {
+				continue
+			}
+			if err := compressFile(name); err != nil {
+				errorCheck(err)
+				continue
+			}
+			rotated[i] = name + ".gz"
+		}
+	}
+
+	if max := conf().LogMaxBackups; max > 0 && len(rotated) > max {
+		for _, name := range rotated[:len(rotated)-max] {
+			errorCheck(os.Remove(name))
+		}
+	}
+}
+
+//Writes name.gz and removes name
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+//Reopens the log file whenever the process receives SIGUSR1, so external rotation tools can move it away
+func reopenLogOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		if logWriter == nil {
+			continue
+		}
+		if err := logWriter.reopen(); err != nil {
+			errorCheck(err)
+			continue
+		}
+		nodeLog.Info("Reopened log file", slog.String("file", logWriter.path), slog.String("signal", "SIGUSR1"))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Sets the log rotation limits until the test ends
+func setRotationConfig(t *testing.T, maxAge time.Duration, maxBackups int) {
+	old := conf()
+	setConfig(func(c *config) {
+		c.LogMaxAge = duration{maxAge}
+		c.LogMaxBackups = maxBackups
+		c.LogCompress = false
+	})
+	t.Cleanup(func() {
+		setConfig(func(c *config) {
+			c.LogMaxAge = old.LogMaxAge
+			c.LogMaxBackups = old.LogMaxBackups
+			c.LogCompress = old.LogCompress
+		})
+	})
+}
+
+//A log file reopened after a restart is as old as its first record, not as the process
+func TestRotationAgeFromFirstRecord(t *testing.T) {
+	setRotationConfig(t, time.Hour, 0)
+	path := filepath.Join(t.TempDir(), "logfile.log")
+	for _, c := range []struct {
+		first  time.Time
+		rotate bool
+	}{{time.Now().Add(-2 * time.Hour), true}, {time.Now().Add(-time.Minute), false}} {
+		line := "time=" + c.first.Format(time.RFC3339Nano) + " level=INFO msg=started\n"
+		if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+			t.Fatal(err)
+		}
+		r, err := openRotatingFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.needsRotation(1); got != c.rotate {
+			t.Errorf("file started %v ago: needsRotation %v, want %v", time.Since(c.first).Round(time.Minute), got, c.rotate)
+		}
+		r.file.Close()
+	}
+}
+
+//Only files named like rotated logs are compressed or removed
+func TestPruneOnlyRotatedLogs(t *testing.T) {
+	setRotationConfig(t, 0, 1)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logfile.log")
+	older := path + "." + time.Now().Add(-time.Hour).Format(ROTATED_LOG_FORMAT) + ".gz"
+	newest := path + "." + time.Now().Format(ROTATED_LOG_FORMAT)
+	for _, name := range []string{path, path + ".bak", path + ".corrupt", older, newest} {
+		if err := os.WriteFile(name, []byte("x\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneRotatedLogs(path)
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	want := []string{path, path + ".bak", path + ".corrupt", newest}
+	if !sameStrings(left, want) {
+		t.Fatalf("files left %v, want %v", left, want)
+	}
+}
+
+//A file that cannot be opened again after a rotation is replaced by stderr instead of a closed handle
+func TestRotationFallsBackToStderr(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRotatingFile(filepath.Join(dir, "logfile.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+
+	r.mutex.Lock()
+	err = r.rotate()
+	r.mutex.Unlock()
+	if err == nil {
+		t.Fatal("rotation into a removed directory succeeded")
+	}
+	if r.file != os.Stderr || r.needsRotation(1<<30) {
+		t.Fatalf("not writing to stderr after the file could not be opened again: %v", r.file.Name())
+	}
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var scenarioPath = flag.String("scenario", "", "Run the chaos scenario in this JSON file on a local cluster and exit")
+
+//First HTTP port of the nodes started by a scenario, node i listens on SCENARIO_HTTP_PORT+i
+const SCENARIO_HTTP_PORT = 20000
+
+//How often the scenario runner reads the membership list of every node
+const SCENARIO_POLL_INTERVAL = 100 * time.Millisecond
+
+//Chaos scenario: a cluster of Nodes VM's on 127.0.0.1..127.0.0.N (node 1 is the introducer), a timeline of
+//actions and the assertions checked once the timeline is done and Duration has passed
+type scenario struct {
+	Name  string `json:"name"`
+	Nodes int    `json:"nodes"`
+	//Config file given to every node, e.g. {"min_hosts": 3, "probe_interval": "500ms"}. Addresses, ports and
+	//file paths are set by the runner
+	Config json.RawMessage `json:"config"`
+	//Settings overriding Config for some nodes, by node, e.g. {"3": {"protocol_max": 1}}
+	NodeConfig map[int]json.RawMessage `json:"node_config,omitempty"`
+	Timeline   []scenarioAction        `json:"timeline"`
+	Duration   duration                `json:"duration"`
+	Assertions []scenarioAssertion     `json:"assertions"`
+}
+
+//Action run At after the cluster has formed:
+//
+//	kill       SIGKILL Nodes
+//	stop       SIGTERM Nodes, they leave gracefully and exit
+//	start      start killed or stopped Nodes again and join them to the group
+//	leave      Nodes leave the group but keep running
+//	join       Nodes join the group again
+//	partition  cut all traffic between the nodes in A and the nodes in B
+//	heal       remove every partition
+//	loss       drop Percent of the messages of Types (all if empty) sent by Nodes (all if empty), 0 to stop
+//	upgrade    stop Nodes one at a time, apply the settings in Config to them and start them again
+type scenarioAction struct {
+	At      duration        `json:"at"`
+	Action  string          `json:"action"`
+	Nodes   []int           `json:"nodes,omitempty"`
+	A       []int           `json:"a,omitempty"`
+	B       []int           `json:"b,omitempty"`
+	Percent int             `json:"percent,omitempty"`
+	Types   []string        `json:"types,omitempty"`
+	Config  json.RawMessage `json:"config,omitempty"`
+}
+
+//Expected outcome:
+//
+//	removed             every observer (default: every running node but Node) removes Node from its membership list
+//	                    within Within of the last kill, stop, leave or partition of Node
+//	no_false_positives  no node marks another as failed outside the times a timeline action made it unreachable:
+//	                    from a kill, stop, leave, partition or upgrade of it until the start, join or heal
+//	                    that undoes it, plus probe_interval and ack_timeout for the probes sent before then
+//	converged           at the end, every node in Nodes (default: every running node still in the group) has
+//	                    exactly Nodes in its membership list
+//	protocol_version    at the end, every node in Nodes (default: every running node) operates at Version
+type scenarioAssertion struct {
+	Expect    string   `json:"expect"`
+	Node      int      `json:"node,omitempty"`
+	Nodes     []int    `json:"nodes,omitempty"`
+	Observers []int    `json:"observers,omitempty"`
+	Within    duration `json:"within"`
+	Version   int      `json:"version,omitempty"`
+}
+
+//Time a timeline action made a node unreachable on purpose. until is zero until the start, join or heal
+//that undoes it
+type disruption struct {
+	action string
+	from   time.Time
+	until  time.Time
+}
+
+//A node started by the runner
+type scenarioNode struct {
+	index   int
+	dir     string
+	cmd     *exec.Cmd
+	running bool
+	//Closed once the process exits
+	exited chan struct{}
+	//Left the group with a leave action (or stop) and has not joined again
+	left   bool
+	faults faultConfig
+}
+
+//State of a running scenario
+type scenarioRun struct {
+	s       scenario
+	dir     string
+	nodes   []*scenarioNode
+	started time.Time
+	//Time of the last kill, stop, leave or partition involving each node
+	touched map[int]time.Time
+	//Times a timeline action made each node unreachable on purpose, failures of it then are expected
+	disruptions map[int][]disruption
+	//Time after a disruption ends during which failures are still expected
+	grace time.Duration
+	//Membership lists seen for each node and the times each member went missing from them
+	lists    map[int][]string
+	removals map[[2]int][]time.Time
+	mutex    sync.Mutex
+	client   *http.Client
+}
+
+//Runs the scenario in path, prints a report and returns the exit status: 0 if every assertion passed
+func runScenario(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var s scenario
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid scenario: "+err.Error())
+		return 2
+	}
+	if err := s.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid scenario: "+err.Error())
+		return 2
+	}
+
+	dir, err := os.MkdirTemp("", "swim-scenario-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	r := &scenarioRun{s: s, dir: dir, touched: make(map[int]time.Time), disruptions: make(map[int][]disruption), grace: s.failureGrace(),
+		lists: make(map[int][]string), removals: make(map[[2]int][]time.Time), client: &http.Client{Timeout: time.Second}}
+	defer r.stopAll()
+
+	fmt.Printf("Scenario %s: %d nodes in %s\n", s.Name, s.Nodes, dir)
+	if err := r.startCluster(); err != nil {
+		fmt.Println("FAIL cluster did not form: " + err.Error())
+		return 1
+	}
+	done := make(chan struct{})
+	go r.poll(done)
+
+	r.started = time.Now()
+	for _, action := range s.Timeline {
+		time.Sleep(time.Until(r.started.Add(action.At.Duration)))
+		fmt.Printf("%8s  %s\n", action.At.String(), action.describe())
+		if err := r.run(action); err != nil {
+			fmt.Println("          error: " + err.Error())
+		}
+	}
+	time.Sleep(s.Duration.Duration)
+	close(done)
+
+	passed := true
+	for _, a := range s.Assertions {
+		ok, detail := r.check(a)
+		status := "PASS"
+		if !ok {
+			status = "FAIL"
+			passed = false
+		}
+		fmt.Printf("%s %s: %s\n", status, a.Expect, detail)
+	}
+	if racy := r.racyNodes(); len(racy) > 0 {
+		fmt.Printf("FAIL data races: reported by nodes %v\n", racy)
+		passed = false
+	}
+	if !passed {
+		fmt.Println("Scenario failed, logs and journals are kept in " + dir)
+		return 1
+	}
+	os.RemoveAll(dir)
+	return 0
+}
+
+func (s scenario) validate() error {
+	if s.Nodes < 2 || s.Nodes > 254 {
+		return errors.New("nodes must be between 2 and 254")
+	}
+	valid := func(nodes []int) error {
+		for _, n := range nodes {
+			if n < 1 || n > s.Nodes {
+				return fmt.Errorf("no node %d", n)
+			}
+		}
+		return nil
+	}
+	for n := range s.NodeConfig {
+		if err := valid([]int{n}); err != nil {
+			return fmt.Errorf("node_config: %v", err)
+		}
+	}
+	for i, a := range s.Timeline {
+		switch a.Action {
+		case "kill", "stop", "start", "leave", "join", "partition", "heal", "loss", "upgrade":
+		default:
+			return fmt.Errorf("timeline %d: unknown action %q", i, a.Action)
+		}
+		for _, nodes := range [][]int{a.Nodes, a.A, a.B} {
+			if err := valid(nodes); err != nil {
+				return fmt.Errorf("timeline %d: %v", i, err)
+			}
+		}
+		if a.Percent < 0 || a.Percent > 100 {
+			return fmt.Errorf("timeline %d: percent must be between 0 and 100", i)
+		}
+	}
+	for i, a := range s.Assertions {
+		switch a.Expect {
+		case "removed", "no_false_positives", "converged", "protocol_version":
+		default:
+			return fmt.Errorf("assertion %d: unknown expectation %q", i, a.Expect)
+		}
+		if a.Expect == "protocol_version" && a.Version == 0 {
+			return fmt.Errorf("assertion %d: protocol_version needs a version", i)
+		}
+		if a.Expect == "removed" && (a.Node < 1 || a.Node > s.Nodes || a.Within.Duration <= 0) {
+			return fmt.Errorf("assertion %d: removed needs a node and within", i)
+		}
+		for _, nodes := range [][]int{a.Nodes, a.Observers} {
+			if err := valid(nodes); err != nil {
+				return fmt.Errorf("assertion %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+//Longest probe_interval + ack_timeout of any node: a probe sent just before a disruption ends can still
+//time out that long after
+func (s scenario) failureGrace() time.Duration {
+	var grace time.Duration
+	for i := 1; i <= s.Nodes; i++ {
+		c := defaultConfig()
+		for _, overlay := range []json.RawMessage{s.Config, s.NodeConfig[i]} {
+			if len(overlay) > 0 {
+				json.Unmarshal(overlay, &c)
+			}
+		}
+		grace = max(grace, c.ProbeInterval.Duration+c.AckTimeout.Duration)
+	}
+	return grace
+}
+
+func (a scenarioAction) describe() string {
+	switch a.Action {
+	case "partition":
+		return fmt.Sprintf("partition %v from %v", a.A, a.B)
+	case "heal":
+		return "heal"
+	case "loss":
+		return fmt.Sprintf("loss %d%% %v on %v", a.Percent, a.Types, a.Nodes)
+	}
+	return fmt.Sprintf("%s %v", a.Action, a.Nodes)
+}
+
+func scenarioHost(i int) string {
+	return "127.0.0." + strconv.Itoa(i) + "/8"
+}
+
+func scenarioIndex(host string) int {
+	i, _ := strconv.Atoi(strings.TrimPrefix(hostIP(host), "127.0.0."))
+	return i
+}
+
+//Starts every node, joins them to the introducer and waits until they all see each other
+func (r *scenarioRun) startCluster() error {
+	for i := 1; i <= r.s.Nodes; i++ {
+		node := &scenarioNode{index: i, dir: filepath.Join(r.dir, "node"+strconv.Itoa(i))}
+		if err := os.MkdirAll(node.dir, 0755); err != nil {
+			return err
+		}
+		config, err := overlayConfig(r.s.Config, r.s.NodeConfig[i])
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(node.dir, "config.json"), config, 0644); err != nil {
+			return err
+		}
+		r.nodes = append(r.nodes, node)
+	}
+	for _, node := range r.nodes {
+		if err := r.start(node); err != nil {
+			return err
+		}
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		formed := true
+		for _, node := range r.nodes {
+			members, err := r.members(node.index)
+			formed = formed && err == nil && len(members) == r.s.Nodes
+		}
+		if formed {
+			return nil
+		}
+		time.Sleep(SCENARIO_POLL_INTERVAL)
+	}
+	return errors.New("not every node saw all members within 30s")
+}
+
+//Starts the process of node and, unless it is the introducer, joins it to the group
+func (r *scenarioRun) start(node *scenarioNode) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	//The previous process must have released data_dir
+	if node.exited != nil {
+		<-node.exited
+	}
+	cmd := exec.Command(executable, "-daemon", "-config", "config.json",
+		"-introducer", scenarioHost(1), "-advertise-addr", scenarioHost(node.index), "-bind-addr", hostIP(scenarioHost(node.index)),
+		"-http-addr", "127.0.0.1:"+strconv.Itoa(SCENARIO_HTTP_PORT+node.index))
+	cmd.Dir = node.dir
+	out, err := os.OpenFile(filepath.Join(node.dir, "out.txt"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		out.Close()
+		close(exited)
+	}()
+	r.mutex.Lock()
+	node.cmd = cmd
+	node.exited = exited
+	node.running = true
+	node.left = false
+	node.faults = faultConfig{}
+	r.mutex.Unlock()
+
+	//Wait for the admin API before joining
+	for i := 0; i < 50; i++ {
+		if _, err = r.members(node.index); err == nil {
+			break
+		}
+		time.Sleep(SCENARIO_POLL_INTERVAL)
+	}
+	if err != nil {
+		return err
+	}
+	if node.index == 1 {
+		return nil
+	}
+	//A node restarted after a kill rejoins by itself
+	if err := r.post(node.index, "/v1/join"); err != nil && !strings.Contains(err.Error(), errAlreadyConnected.Error()) {
+		return err
+	}
+	return nil
+}
+
+//Runs one timeline action
+func (r *scenarioRun) run(a scenarioAction) error {
+	now := time.Now()
+	r.mutex.Lock()
+	switch a.Action {
+	case "kill", "stop", "leave", "upgrade":
+		for _, n := range a.Nodes {
+			r.disrupt(n, a.Action, now)
+		}
+	case "partition":
+		for _, n := range append(a.A, a.B...) {
+			r.disrupt(n, a.Action, now)
+		}
+	case "start":
+		for _, n := range a.Nodes {
+			r.restore(n, now, "kill", "stop")
+		}
+	case "join":
+		for _, n := range a.Nodes {
+			r.restore(n, now, "leave")
+		}
+	case "heal":
+		for n := range r.disruptions {
+			r.restore(n, now, "partition")
+		}
+	}
+	r.mutex.Unlock()
+
+	var errs []string
+	for _, n := range a.Nodes {
+		node := r.nodes[n-1]
+		var err error
+		switch a.Action {
+		case "kill", "stop":
+			sig := syscall.SIGKILL
+			if a.Action == "stop" {
+				sig = syscall.SIGTERM
+				node.left = true
+			}
+			if node.running {
+				err = node.cmd.Process.Signal(sig)
+				r.mutex.Lock()
+				node.running = false
+				r.mutex.Unlock()
+			}
+		case "start":
+			if !node.running {
+				err = r.start(node)
+			}
+		case "leave":
+			node.left = true
+			err = r.post(n, "/v1/leave")
+		case "join":
+			node.left = false
+			err = r.post(n, "/v1/join")
+		case "upgrade":
+			err = r.upgrade(node, a.Config)
+			r.mutex.Lock()
+			r.restore(n, time.Now(), "upgrade")
+			r.mutex.Unlock()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("node %d: %v", n, err))
+		}
+	}
+
+	switch a.Action {
+	case "partition":
+		setA, setB := make([]string, 0), make([]string, 0)
+		for _, n := range a.A {
+			setA = append(setA, scenarioHost(n))
+		}
+		for _, n := range a.B {
+			setB = append(setB, scenarioHost(n))
+		}
+		name := strconv.Itoa(len(r.nodes[0].faults.Partitions))
+		for _, node := range r.nodes {
+			if node.faults.Sets == nil {
+				node.faults.Sets = make(map[string][]string)
+			}
+			node.faults.Sets["a"+name] = setA
+			node.faults.Sets["b"+name] = setB
+			node.faults.Partitions = append(node.faults.Partitions, partition{From: "a" + name, To: "b" + name})
+		}
+	case "heal":
+		for _, node := range r.nodes {
+			node.faults.Sets = nil
+			node.faults.Partitions = nil
+		}
+	case "loss":
+		for _, node := range r.nodes {
+			if len(a.Nodes) == 0 || containsInt(a.Nodes, node.index) {
+				node.faults.Rules = nil
+				if a.Percent > 0 {
+					node.faults.Rules = []faultRule{{Types: a.Types, Drop: a.Percent}}
+				}
+			}
+		}
+	}
+	if a.Action == "partition" || a.Action == "heal" || a.Action == "loss" {
+		for _, node := range r.nodes {
+			if node.running {
+				if err := r.put(node.index, "/v1/faults", node.faults); err != nil {
+					errs = append(errs, fmt.Sprintf("node %d: %v", node.index, err))
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+//Records that an action made node n unreachable at t. Must be called holding r.mutex
+func (r *scenarioRun) disrupt(n int, action string, t time.Time) {
+	r.touched[n] = t
+	r.disruptions[n] = append(r.disruptions[n], disruption{action: action, from: t})
+}
+
+//Ends the disruptions of node n caused by any of actions at t. Must be called holding r.mutex
+func (r *scenarioRun) restore(n int, t time.Time, actions ...string) {
+	for i, d := range r.disruptions[n] {
+		if d.until.IsZero() && slices.Contains(actions, d.action) {
+			r.disruptions[n][i].until = t
+		}
+	}
+}
+
+//Returns true if a timeline action made node n unreachable at t, or did until less than r.grace before.
+//Must be called holding r.mutex
+func (r *scenarioRun) disruptedAt(n int, t time.Time) bool {
+	for _, d := range r.disruptions[n] {
+		if !t.Before(d.from) && (d.until.IsZero() || !t.After(d.until.Add(r.grace))) {
+			return true
+		}
+	}
+	return false
+}
+
+//Stops node gracefully, applies the settings in overlay to its config file and starts it again
+func (r *scenarioRun) upgrade(node *scenarioNode, overlay json.RawMessage) error {
+	if node.running {
+		if err := node.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			return err
+		}
+		<-node.exited
+		r.mutex.Lock()
+		node.running = false
+		r.mutex.Unlock()
+	}
+	path := filepath.Join(node.dir, "config.json")
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config, err := overlayConfig(current, overlay)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, config, 0644); err != nil {
+		return err
+	}
+	return r.start(node)
+}
+
+//Returns the config in base with the settings in overlay added or replaced
+func overlayConfig(base json.RawMessage, overlay json.RawMessage) (json.RawMessage, error) {
+	settings := make(map[string]json.RawMessage)
+	for _, c := range []json.RawMessage{base, overlay} {
+		if len(c) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(c, &settings); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(settings)
+}
+
+func containsInt(list []int, n int) bool {
+	for _, element := range list {
+		if element == n {
+			return true
+		}
+	}
+	return false
+}
+
+//Reads the membership list of every running node until done is closed and records when members disappear
+func (r *scenarioRun) poll(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(SCENARIO_POLL_INTERVAL):
+		}
+		for _, node := range r.nodes {
+			r.mutex.Lock()
+			running := node.running
+			r.mutex.Unlock()
+			if !running {
+				continue
+			}
+			members, err := r.members(node.index)
+			if err != nil {
+				continue
+			}
+			now := time.Now()
+			r.mutex.Lock()
+			for _, host := range r.lists[node.index] {
+				if !containsString(members, host) {
+					key := [2]int{node.index, scenarioIndex(host)}
+					r.removals[key] = append(r.removals[key], now)
+				}
+			}
+			r.lists[node.index] = members
+			r.mutex.Unlock()
+		}
+	}
+}
+
+//Returns the nodes whose output has a data race report. Only binaries built with -race report them
+func (r *scenarioRun) racyNodes() []int {
+	racy := make([]int, 0)
+	for _, node := range r.nodes {
+		b, err := os.ReadFile(filepath.Join(node.dir, "out.txt"))
+		if err == nil && bytes.Contains(b, []byte("WARNING: DATA RACE")) {
+			racy = append(racy, node.index)
+		}
+	}
+	return racy
+}
+
+//Checks one assertion and describes the outcome
+func (r *scenarioRun) check(a scenarioAssertion) (bool, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch a.Expect {
+	case "removed":
+		observers := a.Observers
+		if len(observers) == 0 {
+			for _, node := range r.nodes {
+				if node.running && node.index != a.Node {
+					observers = append(observers, node.index)
+				}
+			}
+		}
+		since, ok := r.touched[a.Node]
+		if !ok {
+			return false, fmt.Sprintf("node %d was never killed, stopped, left or partitioned", a.Node)
+		}
+		var slowest time.Duration
+		var missing []string
+		for _, o := range observers {
+			found := false
+			for _, t := range r.removals[[2]int{o, a.Node}] {
+				if !t.Before(since) && t.Sub(since) <= a.Within.Duration {
+					found = true
+					if t.Sub(since) > slowest {
+						slowest = t.Sub(since)
+					}
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, strconv.Itoa(o))
+			}
+		}
+		if len(missing) > 0 {
+			return false, fmt.Sprintf("node %d not removed within %s by node(s) %s", a.Node, a.Within.String(), strings.Join(missing, ", "))
+		}
+		return true, fmt.Sprintf("node %d removed by %v within %s (slowest %s)", a.Node, observers, a.Within.String(), slowest.Round(time.Millisecond))
+
+	case "no_false_positives":
+		var wrong []string
+		for _, node := range r.nodes {
+			f, err := os.Open(filepath.Join(node.dir, "data", "journal.jsonl"))
+			if err != nil {
+				continue
+			}
+			decoder := json.NewDecoder(f)
+			for {
+				var e journalEntry
+				if decoder.Decode(&e) != nil {
+					break
+				}
+				if e.New != STATE_FAILED {
+					continue
+				}
+				t, err := time.Parse(time.RFC3339Nano, e.Time)
+				if err != nil || !r.disruptedAt(scenarioIndex(e.Host), t) {
+					wrong = append(wrong, fmt.Sprintf("node %d marked node %d failed at %s", node.index, scenarioIndex(e.Host), e.Time))
+				}
+			}
+			f.Close()
+		}
+		if len(wrong) > 0 {
+			return false, strings.Join(wrong, "; ")
+		}
+		return true, "no healthy node was marked as failed"
+
+	case "converged":
+		expected := a.Nodes
+		if len(expected) == 0 {
+			for _, node := range r.nodes {
+				if node.running && !node.left {
+					expected = append(expected, node.index)
+				}
+			}
+		}
+		sort.Ints(expected)
+		for _, n := range expected {
+			got := make([]int, 0)
+			for _, host := range r.lists[n] {
+				got = append(got, scenarioIndex(host))
+			}
+			sort.Ints(got)
+			if fmt.Sprint(got) != fmt.Sprint(expected) {
+				return false, fmt.Sprintf("node %d has %v, expected %v", n, got, expected)
+			}
+		}
+		return true, fmt.Sprintf("every node in %v sees exactly %v", expected, expected)
+
+	case "protocol_version":
+		nodes := a.Nodes
+		if len(nodes) == 0 {
+			for _, node := range r.nodes {
+				if node.running {
+					nodes = append(nodes, node.index)
+				}
+			}
+		}
+		for _, n := range nodes {
+			var self selfInfo
+			resp, err := r.client.Get(r.url(n, "/v1/self"))
+			if err != nil {
+				return false, fmt.Sprintf("node %d: %v", n, err)
+			}
+			err = json.NewDecoder(resp.Body).Decode(&self)
+			resp.Body.Close()
+			if err != nil {
+				return false, fmt.Sprintf("node %d: %v", n, err)
+			}
+			if self.ProtocolVersion != a.Version {
+				return false, fmt.Sprintf("node %d operates at version %d, expected %d", n, self.ProtocolVersion, a.Version)
+			}
+		}
+		return true, fmt.Sprintf("every node in %v operates at version %d", nodes, a.Version)
+	}
+	return false, "unknown expectation"
+}
+
+//Kills every node still running
+func (r *scenarioRun) stopAll() {
+	for _, node := range r.nodes {
+		if node.running {
+			node.cmd.Process.Kill()
+		}
+	}
+}
+
+func (r *scenarioRun) url(n int, path string) string {
+	return "http://127.0.0.1:" + strconv.Itoa(SCENARIO_HTTP_PORT+n) + path
+}
+
+//Returns the hosts in the membership list of node n
+func (r *scenarioRun) members(n int) ([]string, error) {
+	resp, err := r.client.Get(r.url(n, "/v1/members"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var members []memberInfo
+	if err := json.NewDecoder(resp.Body).Decode(&members); err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0, len(members))
+	for _, m := range members {
+		hosts = append(hosts, m.Host)
+	}
+	return hosts, nil
+}
+
+func (r *scenarioRun) post(n int, path string) error {
+	return r.do(http.MethodPost, n, path, nil)
+}
+
+func (r *scenarioRun) put(n int, path string, v interface{}) error {
+	return r.do(http.MethodPut, n, path, v)
+}
+
+func (r *scenarioRun) do(method string, n int, path string, v interface{}) error {
+	var body bytes.Buffer
+	if v != nil {
+		if err := json.NewEncoder(&body).Encode(v); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, r.url(n, path), &body)
+	if err != nil {
+		return err
+	}
+	//Leaving waits for leave_timeout
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e map[string]string
+		json.NewDecoder(resp.Body).Decode(&e)
+		return errors.New(resp.Status + " " + e["error"])
+	}
+	return nil
+}
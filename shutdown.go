@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//Exit status after a shutdown in which the departure was acknowledged by the members monitoring
+//this VM (or there was no group to leave)
+const EXIT_LEFT = 0
+
+//Exit status after a shutdown in which leave_timeout ran out before the departure was acknowledged.
+//The rest of the group may still mark this VM as Failed
+const EXIT_LEAVE_UNCONFIRMED = 3
+
+//Set to 1 once the node starts shutting down. Stops probing and failure detection
+var stopping int32
+
+//Hosts that acknowledged our Adios, only used while leaving
+var leaveAcks = make(map[string]bool)
+
+//Mutex used for leaveAcks
+var leaveMutex = &sync.Mutex{}
+
+//UDP servers, closed on shutdown
+var messageConn *net.UDPConn
+var listConn *net.UDPConn
+
+//Mutex used for the servers closed on shutdown, which are set by the goroutines running them
+var serversMutex = &sync.Mutex{}
+
+//Leaves the group and exits when the process receives SIGINT or SIGTERM
+func handleShutdownSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	nodeLog.Info("Shutting down", slog.String("signal", s.String()))
+	shutdown()
+}
+
+//Returns true once the node has started shutting down
+func isStopping() bool {
+	return atomic.LoadInt32(&stopping) == 1
+}
+
+//Announces our departure if we are part of a group, stops the node and exits. A member saves the state
+//it left the group in, so it does not rejoin when it is started again. The introducer keeps its
+//membershipList so it can rebuild the group when it restarts
+func shutdown() {
+	confirmed := true
+	if s := snapshot(); currHost == conf().Introducer || s.Connected {
+		confirmed = leaveGroup()
+		membershipLog.Info("Left group", slog.Bool("confirmed", confirmed), incarnationAttr(s.Incarnation))
+		if currHost != conf().Introducer {
+			recordEvent(currHost, "left", s.Incarnation, currHost)
+			resetMembership()
+		}
+	}
+	exitAfterLeave(confirmed)
+}
+
+//Stops the node and exits with EXIT_LEFT or EXIT_LEAVE_UNCONFIRMED
+func exitAfterLeave(confirmed bool) {
+	stopNode()
+	if confirmed {
+		os.Exit(EXIT_LEFT)
+	}
+	os.Exit(EXIT_LEAVE_UNCONFIRMED)
+}
+
+//Stops probing, failure detection and every listener. Waits at most a second for
+//in-flight HTTP requests to finish
+func stopNode() {
+	atomic.StoreInt32(&stopping, 1)
+
+	serversMutex.Lock()
+	if messageConn != nil {
+		messageConn.Close()
+	}
+	if listConn != nil {
+		listConn.Close()
+	}
+	if queryListener != nil {
+		queryListener.Close()
+	}
+	if controlListener != nil {
+		controlListener.Close()
+		os.Remove(conf().ControlSocket)
+	}
+	if adminServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		adminServer.Shutdown(ctx)
+		cancel()
+	}
+	serversMutex.Unlock()
+	errorCheck(saveState())
+}
+
+//Called when an AdiosACK is received while leaving
+func recordLeaveAck(host string) {
+	leaveMutex.Lock()
+	leaveAcks[host] = true
+	leaveMutex.Unlock()
+}
+
+//Returns the hosts that have not acknowledged our Adios yet
+func pendingLeaveAcks(hosts []string) []string {
+	leaveMutex.Lock()
+	defer leaveMutex.Unlock()
+	pending := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !leaveAcks[host] {
+			pending = append(pending, host)
+		}
+	}
+	return pending
+}
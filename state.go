@@ -0,0 +1,154 @@
+package main
+
+import (
+	"maps"
+	"sync/atomic"
+	"time"
+)
+
+//Membership state of the local VM. Owned by stateLoop: it is only changed by the functions passed to
+//updateState, which run one at a time on the loop, and every change is published as a new snapshot.
+//Snapshots are shared by every reader and must never be modified
+type groupState struct {
+	//Contains all members connected to the group, sorted by host
+	Members []member
+	//True if the VM is currently connected to the group (or trying to join one)
+	Connected bool
+	//Incarnation of the local VM. Bumped every time the VM leaves the group so that when it joins again
+	//the group treats it as a new member instead of the one that left
+	Incarnation int
+	//Members marked as Failed that are still sent reconnect probes, by host. Saved to data_dir with the
+	//membershipList
+	Departed map[string]departedMember
+}
+
+//A change waiting for stateLoop. apply returns false if it did not change the state
+type stateUpdate struct {
+	apply func(s *groupState) bool
+	done  chan bool
+}
+
+var stateUpdates = make(chan stateUpdate)
+
+//Last state published by stateLoop
+var currentState atomic.Pointer[groupState]
+
+//Publishes the initial state of the VM and starts the loop that owns it
+func initializeState(incarnation int) {
+	s := groupState{Incarnation: incarnation, Departed: make(map[string]departedMember)}
+	s.Members = []member{{Host: currHost, TimeStamp: time.Now().Format(time.RFC850), Tags: conf().Tags, Incarnation: incarnation,
+		MinVersion: conf().ProtocolMin, MaxVersion: conf().ProtocolMax}}
+	currentState.Store(s.clone())
+	go stateLoop(s)
+}
+
+//Applies the updates one at a time and publishes a snapshot after each one that changed the state
+func stateLoop(s groupState) {
+	for u := range stateUpdates {
+		changed := u.apply(&s)
+		if changed {
+			currentState.Store(s.clone())
+		}
+		u.done <- changed
+	}
+}
+
+//Runs apply on the state loop and waits for it. apply must return true if it changed the state, in
+//which case the new state is saved to data_dir. apply must not call updateState and sees the state
+//through its argument only: snapshot() still returns the state from before it ran
+func updateState(apply func(s *groupState) bool) {
+	u := stateUpdate{apply, make(chan bool, 1)}
+	stateUpdates <- u
+	//Saved after the snapshot is published, so the writer never sees an older one
+	if <-u.done {
+		persistState()
+	}
+}
+
+//Returns the last published state. Never modify it
+func snapshot() *groupState {
+	return currentState.Load()
+}
+
+//Returns a copy of s that does not share its membershipList or departed members
+func (s *groupState) clone() *groupState {
+	c := *s
+	c.Members = append([]member(nil), s.Members...)
+	c.Departed = maps.Clone(s.Departed)
+	return &c
+}
+
+//Returns the index of host in the membershipList or -1 if it is not a member
+func (s *groupState) indexOf(host string) int {
+	for i, element := range s.Members {
+		if element.Host == host {
+			return i
+		}
+	}
+	return -1
+}
+
+//Returns true if host is in the membershipList
+func (s *groupState) contains(host string) bool {
+	return s.indexOf(host) != -1
+}
+
+//Returns the host at (localIndex + i)%N, where N is size of membershipList
+func (s *groupState) successor(i int) string {
+	return s.Members[(s.indexOf(currHost)+i)%len(s.Members)].Host
+}
+
+//Returns the hosts at (localIndex + i)%N for i = 1..n other than the local VM, without duplicates. In a
+//group of N <= n members the successors wrap around onto each other and onto the local VM, so there are
+//only N-1 of them
+func (s *groupState) successors(n int) []string {
+	hosts := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		host := s.successor(i)
+		if host != currHost && !containsString(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+//Returns the hosts at (localIndex - i)%N for i = 1..n other than the local VM, without duplicates. These
+//are the members monitoring the local VM if they use the same fanout. Empty if the VM is not a member
+func (s *groupState) predecessors(n int) []string {
+	hosts := make([]string, 0, n)
+	localIndex := s.indexOf(currHost)
+	if localIndex == -1 {
+		return hosts
+	}
+	for i := 1; i <= n; i++ {
+		var targetHostIndex = (localIndex - i) % len(s.Members)
+		if targetHostIndex < 0 {
+			targetHostIndex = len(s.Members) + targetHostIndex
+		}
+		host := s.Members[targetHostIndex].Host
+		if host != currHost && !containsString(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+//Returns the hosts in the membershipList other than the local VM
+func (s *groupState) others() []string {
+	hosts := make([]string, 0, len(s.Members))
+	for _, element := range s.Members {
+		if element.Host != currHost {
+			hosts = append(hosts, element.Host)
+		}
+	}
+	return hosts
+}
+
+//Sets whether the VM is connected to the group
+func setConnected(connected bool) {
+	updateState(func(s *groupState) bool {
+		changed := s.Connected != connected
+		s.Connected = connected
+		return changed
+	})
+}
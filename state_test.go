@@ -0,0 +1,240 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//Checks the invariants every published snapshot must hold
+func checkSnapshot(t *testing.T, s *groupState) {
+	if !sort.IsSorted(memList(s.Members)) {
+		t.Errorf("membershipList not sorted: %v", s.Members)
+	}
+	seen := make(map[string]bool)
+	for _, element := range s.Members {
+		if seen[element.Host] {
+			t.Errorf("%s is in the membershipList twice", element.Host)
+		}
+		seen[element.Host] = true
+	}
+	if !seen[currHost] {
+		t.Errorf("local VM is not in the membershipList")
+	}
+	for host := range s.Departed {
+		if seen[host] {
+			t.Errorf("%s is both a member and departed", host)
+		}
+	}
+}
+
+//Drives every writer of the membership state from many goroutines while readers walk the snapshots.
+//Run with -race: a reader seeing a snapshot change under it fails the test
+func TestConcurrentStateUpdates(t *testing.T) {
+	setMembers(t, 2, 3, 4, 5, 6, 7, 8)
+	var stop atomic.Bool
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for !stop.Load() {
+				s := snapshot()
+				checkSnapshot(t, s)
+				s.successors(conf().Fanout)
+				s.predecessors(conf().Fanout)
+				s.others()
+				for _, d := range s.Departed {
+					_ = d.member.Host
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 200; i++ {
+				host := 2 + (w+i)%7
+				switch i % 5 {
+				case 0:
+					updateState(func(s *groupState) bool {
+						return addMember(s, testMember(host, i))
+					})
+				case 1:
+					msg := newMsg(testHost(host), "Failed")
+					msg.Incarnation = i
+					propagateMsg(msg)
+				case 2:
+					answerProbe(testHost(host))
+				case 3:
+					departedHosts()
+				case 4:
+					if w == 0 {
+						resetMembership()
+					}
+				}
+			}
+		}(w)
+	}
+	writers.Wait()
+	stop.Store(true)
+	readers.Wait()
+	checkSnapshot(t, snapshot())
+}
+
+//Published snapshots are never changed by later updates
+func TestSnapshotIsImmutable(t *testing.T) {
+	setMembers(t, 2, 3)
+	before := snapshot()
+	msg := newMsg(testHost(2), "Failed")
+	msg.Incarnation = 1
+	propagateMsg(msg)
+
+	if !before.contains(testHost(2)) || len(before.Departed) != 0 {
+		t.Fatalf("snapshot changed by propagateMsg: %v", before)
+	}
+	after := snapshot()
+	if after.contains(testHost(2)) {
+		t.Fatalf("failed member still in the membershipList")
+	}
+	if _, ok := after.Departed[testHost(2)]; !ok {
+		t.Fatalf("failed member not departed")
+	}
+}
+
+//Departed members are dropped through the state loop once reconnect_timeout has passed
+func TestDepartedHostsExpire(t *testing.T) {
+	setMembers(t, 2)
+	updateState(func(s *groupState) bool {
+		s.Departed[testHost(3)] = departedMember{testMember(3, 1), time.Now().Add(-time.Hour)}
+		s.Departed[testHost(4)] = departedMember{testMember(4, 1), time.Now()}
+		return true
+	})
+	setConfig(func(c *config) { c.ReconnectTimeout = duration{time.Minute} })
+	defer setConfig(func(c *config) { c.ReconnectTimeout = defaultConfig().ReconnectTimeout })
+
+	hosts := departedHosts()
+	if len(hosts) != 1 || hosts[0] != testHost(4) {
+		t.Fatalf("departedHosts() = %v, want [%s]", hosts, testHost(4))
+	}
+	if _, ok := snapshot().Departed[testHost(3)]; ok {
+		t.Fatalf("expired member still departed in the published state")
+	}
+}
+
+//Leaving the group forgets the members and the departed ones and bumps the incarnation
+func TestResetMembership(t *testing.T) {
+	setMembers(t, 2, 3)
+	updateState(func(s *groupState) bool {
+		s.markDeparted(testMember(4, 1))
+		return true
+	})
+	incarnation := snapshot().Incarnation
+
+	resetMembership()
+	s := snapshot()
+	if len(s.Members) != 1 || s.Members[0].Host != currHost {
+		t.Fatalf("membershipList after reset = %v", s.Members)
+	}
+	if len(s.Departed) != 0 || s.Connected || s.Incarnation != incarnation+1 {
+		t.Fatalf("state after reset = %+v", s)
+	}
+}
+
+//Returns a groupState with the test VM's 1..n, sorted like a membershipList
+func testGroup(n int) *groupState {
+	s := &groupState{Departed: make(map[string]departedMember)}
+	for i := 1; i <= n; i++ {
+		addMember(s, testMember(i, 1))
+	}
+	return s
+}
+
+//Runs fn with host as the local VM
+func asHost(host string, fn func()) {
+	previous := currHost
+	currHost = host
+	defer func() { currHost = previous }()
+	fn()
+}
+
+func TestSuccessorsAndPredecessors(t *testing.T) {
+	s := testGroup(5)
+	hosts := make([]string, len(s.Members))
+	for i, element := range s.Members {
+		hosts[i] = element.Host
+	}
+	cases := []struct {
+		local        int
+		n            int
+		successors   []string
+		predecessors []string
+	}{
+		{0, 1, hosts[1:2], hosts[4:5]},
+		{0, 2, hosts[1:3], []string{hosts[4], hosts[3]}},
+		{4, 2, []string{hosts[0], hosts[1]}, []string{hosts[3], hosts[2]}},
+		{2, 4, []string{hosts[3], hosts[4], hosts[0], hosts[1]}, []string{hosts[1], hosts[0], hosts[4], hosts[3]}},
+		//Wrapping around onto the local VM and onto each other
+		{1, 5, []string{hosts[2], hosts[3], hosts[4], hosts[0]}, []string{hosts[0], hosts[4], hosts[3], hosts[2]}},
+		{1, 9, []string{hosts[2], hosts[3], hosts[4], hosts[0]}, []string{hosts[0], hosts[4], hosts[3], hosts[2]}},
+	}
+	for _, c := range cases {
+		asHost(hosts[c.local], func() {
+			if got := s.successors(c.n); !slices.Equal(got, c.successors) {
+				t.Errorf("successors(%d) of %s = %v, want %v", c.n, hosts[c.local], got, c.successors)
+			}
+			if got := s.predecessors(c.n); !slices.Equal(got, c.predecessors) {
+				t.Errorf("predecessors(%d) of %s = %v, want %v", c.n, hosts[c.local], got, c.predecessors)
+			}
+		})
+	}
+
+	asHost(testHost(1), func() {
+		if got := testGroup(1).successors(2); len(got) != 0 {
+			t.Errorf("successors in a group of 1 = %v", got)
+		}
+	})
+	asHost(testHost(9), func() {
+		if got := s.predecessors(2); len(got) != 0 {
+			t.Errorf("predecessors of a VM that is not a member = %v", got)
+		}
+	})
+}
+
+//Every member is monitored by exactly its predecessors, for any group size and fanout
+func TestPredecessorsMonitor(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		s := testGroup(n)
+		for fanout := 1; fanout <= 4; fanout++ {
+			monitors := make(map[string][]string)
+			for _, element := range s.Members {
+				asHost(element.Host, func() {
+					for _, host := range s.successors(fanout) {
+						monitors[host] = append(monitors[host], element.Host)
+					}
+				})
+			}
+			for _, element := range s.Members {
+				asHost(element.Host, func() {
+					if want := s.predecessors(fanout); !sameStrings(monitors[element.Host], want) {
+						t.Errorf("N=%d fanout=%d: %s monitored by %v, predecessors %v", n, fanout, element.Host, monitors[element.Host], want)
+					}
+				})
+			}
+		}
+	}
+}
+
+//Returns true if a and b hold the same strings in any order
+func sameStrings(a []string, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
@@ -0,0 +1,313 @@
+//swimctl talks to a running node over its Unix domain socket
+//
+//	swimctl [-socket path] [-json] <command> [args]
+//
+//Commands:
+//
+//	members               list the membership list
+//	join [seed ...]       join the group through the seeds (default: the introducer)
+//	leave                 leave the group, the node keeps running and can join again
+//	info                  show the identity and configuration of the node
+//	config                show the effective configuration of the node
+//	reload                reload the node's config file
+//	stats                 show the node's counters
+//	rtt a [b]             estimate the round trip time between members a and b (default: this node)
+//	nearest [-n count] [host]
+//	                      list the members closest to host (default: this node) by estimated round trip time
+//	events [-follow] [n]  show the n most recent events, or stream them as they happen
+//	grep [-level l] [-since t] [-until t] [-local] pattern
+//	                      search the logs of every member (or only this node with -local). Times are
+//	                      RFC3339 or a duration ago, e.g. -since 10m. Exits with 1 if a member could not be searched
+//	history [-host h] [-state s] [-since t] [-until t]
+//	                      show the membership transitions journaled by this node, e.g. -state failed
+//	faults [set file | clear]
+//	                      show the faults the node injects, replace them with the JSON in file (- for stdin)
+//	                      or clear them
+//	recovery              show whether the introducer recovered the group from its saved state and which
+//	                      members were confirmed, dropped or unreachable
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+//Same as controlRequest in the node
+type request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Follow  bool     `json:"follow,omitempty"`
+	Query   query    `json:"query,omitempty"`
+	Journal journal  `json:"journal,omitempty"`
+}
+
+//Same as journalQuery in the node
+type journal struct {
+	Host  string `json:"host,omitempty"`
+	State string `json:"state,omitempty"`
+	Since string `json:"since,omitempty"`
+	Until string `json:"until,omitempty"`
+}
+
+//Same as logQuery in the node
+type query struct {
+	Pattern string `json:"pattern"`
+	Level   string `json:"level,omitempty"`
+	Since   string `json:"since,omitempty"`
+	Until   string `json:"until,omitempty"`
+	Local   bool   `json:"local,omitempty"`
+}
+
+//Last record of a grep for each member
+type grepSummary struct {
+	Host    string `json:"host"`
+	Matches int    `json:"matches"`
+	Error   string `json:"error"`
+}
+
+var summaries []grepSummary
+
+//Same as controlResponse in the node, with the result left undecoded
+type response struct {
+	OK     bool            `json:"ok"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+var socket = flag.String("socket", "data/swim.sock", "Path of the node's control socket, control_socket inside data_dir")
+var jsonOutput = flag.Bool("json", false, "Print raw JSON results, one per line")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: swimctl [-socket path] [-json] <command> [args]")
+	fmt.Fprintln(os.Stderr, "commands: members, join [seed ...], leave, info, config, reload, stats, rtt a [b], nearest [-n count] [host],")
+	fmt.Fprintln(os.Stderr, "          events [-follow] [n], grep [-level l] [-since t] [-until t] [-local] pattern,")
+	fmt.Fprintln(os.Stderr, "          history [-host h] [-state s] [-since t] [-until t], faults [set file | clear], recovery")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	req := request{Command: flag.Arg(0), Args: flag.Args()[1:]}
+	if req.Command == "events" {
+		events := flag.NewFlagSet("events", flag.ExitOnError)
+		follow := events.Bool("follow", false, "Stream events as they happen")
+		events.Parse(req.Args)
+		req.Follow = *follow
+		req.Args = events.Args()
+	}
+	if req.Command == "grep" {
+		grep := flag.NewFlagSet("grep", flag.ExitOnError)
+		level := grep.String("level", "", "Minimum level, debug, info, warn or error")
+		since := grep.String("since", "", "Only lines after this RFC3339 time or duration ago")
+		until := grep.String("until", "", "Only lines before this RFC3339 time or duration ago")
+		local := grep.Bool("local", false, "Only search the log of this node")
+		grep.Parse(req.Args)
+		if grep.NArg() != 1 {
+			usage()
+			os.Exit(2)
+		}
+		req.Query = query{grep.Arg(0), *level, *since, *until, *local}
+		req.Args = nil
+	}
+	if req.Command == "faults" && len(req.Args) == 2 && req.Args[0] == "set" {
+		var b []byte
+		var err error
+		if req.Args[1] == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(req.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "swimctl:", err)
+			os.Exit(1)
+		}
+		req.Args[1] = string(b)
+	}
+	if req.Command == "nearest" {
+		nearest := flag.NewFlagSet("nearest", flag.ExitOnError)
+		n := nearest.Int("n", -1, "Number of members to list, all if negative")
+		nearest.Parse(req.Args)
+		if nearest.NArg() > 1 {
+			usage()
+			os.Exit(2)
+		}
+		req.Args = []string{nearest.Arg(0), strconv.Itoa(*n)}
+	}
+	if req.Command == "history" {
+		history := flag.NewFlagSet("history", flag.ExitOnError)
+		host := history.String("host", "", "Only transitions of this member")
+		state := history.String("state", "", "Only transitions to this state, alive, failed or left")
+		since := history.String("since", "", "Only transitions after this RFC3339 time or duration ago")
+		until := history.String("until", "", "Only transitions before this RFC3339 time or duration ago")
+		history.Parse(req.Args)
+		req.Journal = journal{*host, *state, *since, *until}
+		req.Args = nil
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "swimctl: cannot reach node:", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		fmt.Fprintln(os.Stderr, "swimctl:", err)
+		os.Exit(1)
+	}
+
+	//Every response is one line. Only events -follow sends more than one
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var resp response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			fmt.Fprintln(os.Stderr, "swimctl: bad response:", err)
+			os.Exit(1)
+		}
+		if !resp.OK {
+			fmt.Fprintln(os.Stderr, "swimctl:", resp.Error)
+			os.Exit(1)
+		}
+		if *jsonOutput {
+			fmt.Println(string(resp.Result))
+		} else {
+			printResult(req.Command, req.Follow, resp.Result)
+		}
+	}
+	if req.Command == "grep" {
+		printSummaries()
+	}
+}
+
+//Prints a result in a human readable form
+func printResult(command string, follow bool, result json.RawMessage) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	switch {
+	case command == "members":
+		var members []map[string]interface{}
+		json.Unmarshal(result, &members)
+		fmt.Fprintln(w, "HOST\tSTATE\tRTT\tSINCE")
+		for _, m := range members {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m["host"], m["state"], orDash(m["rtt"]), m["timestamp"])
+		}
+	case command == "rtt" || command == "nearest":
+		var rtts []map[string]interface{}
+		if command == "rtt" {
+			rtts = make([]map[string]interface{}, 1)
+			json.Unmarshal(result, &rtts[0])
+		} else {
+			json.Unmarshal(result, &rtts)
+		}
+		fmt.Fprintln(w, "FROM\tTO\tRTT")
+		for _, r := range rtts {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", r["from"], r["to"], r["rtt"])
+		}
+	case command == "events" && follow:
+		var e map[string]interface{}
+		json.Unmarshal(result, &e)
+		fmt.Fprintf(w, "%v\t%v\t%v\n", e["time"], e["type"], e["host"])
+	case command == "grep":
+		var line struct {
+			grepSummary
+			Line string `json:"line"`
+			Done bool   `json:"done"`
+		}
+		json.Unmarshal(result, &line)
+		if line.Done {
+			summaries = append(summaries, line.grepSummary)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\n", line.Host, line.Line)
+		}
+	case command == "history":
+		var entries []map[string]interface{}
+		json.Unmarshal(result, &entries)
+		fmt.Fprintln(w, "TIME\tHOST\tOLD\tNEW\tINCARNATION\tBY")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", e["t"], e["h"], orDash(e["o"]), e["n"], e["i"], orDash(e["by"]))
+		}
+	case command == "events":
+		var events []map[string]interface{}
+		json.Unmarshal(result, &events)
+		for _, e := range events {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", e["time"], e["type"], e["host"])
+		}
+	default:
+		var values map[string]interface{}
+		if json.Unmarshal(result, &values) != nil {
+			fmt.Fprintln(w, string(result))
+			return
+		}
+		printMap(w, "", values)
+	}
+}
+
+//Prints the number of matches per member to stderr and exits with 1 if a member could not be searched
+func printSummaries() {
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Host < summaries[j].Host })
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tMATCHES\tERROR")
+	failed := false
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", s.Host, s.Matches, orDash(nonEmpty(s.Error)))
+		failed = failed || s.Error != ""
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func nonEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+//Prints a (possibly nested) map as sorted key/value lines
+func printMap(w *tabwriter.Writer, prefix string, values map[string]interface{}) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if nested, ok := values[key].(map[string]interface{}); ok {
+			printMap(w, prefix+key+".", nested)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s\t%v\n", prefix, key, format(values[key]))
+	}
+}
+
+//Prints whole numbers without an exponent
+func format(v interface{}) string {
+	if f, ok := v.(float64); ok && f == float64(int64(f)) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return fmt.Sprint(v)
+}
+
+func orDash(v interface{}) interface{} {
+	if v == nil {
+		return "-"
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+//Protocol versions this build can speak:
+//
+//	1  membership lists are sent as a plain []member (builds without protocol versions or cluster names).
+//	   Messages and lists leave out coordinates, merged lists and tags, and Merge and Tags are not sent
+//	2  membership lists are sent as a memberList carrying the cluster name and version
+const PROTOCOL_VERSION_MIN = 1
+const PROTOCOL_VERSION_MAX = 2
+
+//Version of the last membership list sent or received, reported on /metrics
+var protocolVersion int64
+
+//Returns the protocol versions a member supports. Members that did not advertise any (older builds,
+//or entries rebuilt from membership_file) only speak version 1
+func versionRange(minVersion int, maxVersion int) (int, int) {
+	if minVersion == 0 || maxVersion == 0 {
+		return 1, 1
+	}
+	return minVersion, maxVersion
+}
+
+//Returns the range of protocol versions every member in list supports, skipping except. The range is
+//empty (min > max) if the members have nothing in common
+func commonVersions(list []member, except string) (int, int) {
+	lo, hi := PROTOCOL_VERSION_MIN, PROTOCOL_VERSION_MAX
+	for _, element := range list {
+		if element.Host == except {
+			continue
+		}
+		minVersion, maxVersion := versionRange(element.MinVersion, element.MaxVersion)
+		lo = max(lo, minVersion)
+		hi = min(hi, maxVersion)
+	}
+	return lo, hi
+}
+
+//Returns the version the group operates at: the highest one every member in list supports
+func groupVersion(list []member) int {
+	lo, hi := commonVersions(list, "")
+	if hi < lo {
+		return lo
+	}
+	return hi
+}
+
+//Called by the introducer for a Joining message. Returns false, and answers with VersionMismatch carrying
+//the versions the group supports, if the joining VM has no version in common with the rest of the group
+func compatibleJoin(msg message) bool {
+	lo, hi := commonVersions(snapshot().Members, msg.Host)
+	minVersion, maxVersion := versionRange(msg.MinVersion, msg.MaxVersion)
+	if max(lo, minVersion) <= min(hi, maxVersion) {
+		return true
+	}
+	membershipLog.Warn("Rejected join, no protocol version in common", peerAttr(msg.Host), slog.String("supports", fmt.Sprintf("%d-%d", minVersion, maxVersion)), slog.String("group", fmt.Sprintf("%d-%d", lo, hi)))
+	reply := newMsg(currHost, "VersionMismatch")
+	reply.MinVersion, reply.MaxVersion = lo, hi
+	sendMsg(reply, []string{msg.Host})
+	return false
+}
+
+//Called when a seed answers our Joining with VersionMismatch
+func versionMismatch(msg message) {
+	signalJoin(fmt.Errorf("seed %s: the group speaks protocol versions %d-%d, this node %d-%d", msg.Host, msg.MinVersion, msg.MaxVersion, conf().ProtocolMin, conf().ProtocolMax))
+}
+
+//Returns the version messages are sent at: the one the group in the membershipList operates at or, when
+//the VM is alone (e.g. joining), the version of the last list sent or received, if any
+func messageVersion() int {
+	s := snapshot()
+	if len(s.Members) > 1 {
+		return groupVersion(s.Members)
+	}
+	if version := atomic.LoadInt64(&protocolVersion); version != 0 {
+		return int(version)
+	}
+	return conf().ProtocolMax
+}
+
+//Returns msg without the fields builds older than version 2 do not know about. Those builds read messages
+//into a 1024 byte buffer, which an ACK carrying the coordinates of the group would overflow
+func (msg message) atVersion(version int) message {
+	if version < 2 {
+		msg.Coords = nil
+		msg.Members = nil
+		msg.Tags = nil
+	}
+	return msg
+}
+
+//Encodes list at the version the group operates at, so members running older builds can still decode it.
+//Version 1 lists leave out the tags, which builds without protocol versions do not know about
+func encodeList(list []member) ([]byte, error) {
+	version := groupVersion(list)
+	setProtocolVersion(version)
+	var buf bytes.Buffer
+	var err error
+	if version == 1 {
+		stripped := make([]member, len(list))
+		for i, element := range list {
+			stripped[i] = element
+			stripped[i].Tags = nil
+		}
+		err = gob.NewEncoder(&buf).Encode(stripped)
+	} else {
+		err = gob.NewEncoder(&buf).Encode(memberList{Version: version, Cluster: conf().ClusterName, Members: list})
+	}
+	return buf.Bytes(), err
+}
+
+//Decodes a membership list of any supported version. Version 1 lists carry no cluster name and are
+//treated as coming from our own cluster: a group with a cluster_name sends them as soon as one of its
+//members only speaks version 1, and labelling them default would make every member drop them
+func decodeList(data []byte) (memberList, error) {
+	var mL memberList
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&mL)
+	if err == nil {
+		return mL, nil
+	}
+	var members []member
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&members) != nil {
+		return mL, err
+	}
+	return memberList{Version: 1, Cluster: conf().ClusterName, Members: members}, nil
+}
+
+//Records the version of the last list sent or received and logs when the group changes version
+func setProtocolVersion(version int) {
+	if previous := atomic.SwapInt64(&protocolVersion, int64(version)); previous != int64(version) && previous != 0 {
+		membershipLog.Info("Group protocol version changed", slog.Int64("from", previous), slog.Int("to", version))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+)
+
+//Size of the buffer builds without protocol versions read messages and membership lists into
+const BASELINE_BUFFER_SIZE = 1024
+
+//message and member as defined by builds without protocol versions
+type baselineMessage struct {
+	Host      string
+	Status    string
+	TimeStamp string
+}
+
+type baselineMember struct {
+	Host      string
+	TimeStamp string
+}
+
+//Adds an old member to the group so it operates at version 1
+func addOldMember(t *testing.T, i int) {
+	t.Helper()
+	updateState(func(s *groupState) bool {
+		return addMember(s, oldMember(i))
+	})
+}
+
+//Gives every test VM in hosts a coordinate, as if learned from ACK's
+func learnCoordinates(hosts ...int) {
+	coords := make(map[string]coordinate)
+	for _, i := range hosts {
+		c := newCoordinate()
+		for d := range c.Vec {
+			c.Vec[d] = float64(i*VIVALDI_DIMENSIONS+d) * 1.37e-4
+		}
+		c.Height = 2.3e-4
+		c.Error = 0.43
+		coords[testHost(i)] = c
+	}
+	mergeCoordinates(coords)
+}
+
+//Reads the ACK sendAck sends to the local VM into a buffer of size bytes
+func receiveAck(t *testing.T, size int) []byte {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := defaultConfig().MessagePort
+	setConfig(func(c *config) { c.MessagePort = conn.LocalAddr().(*net.UDPAddr).Port })
+	defer setConfig(func(c *config) { c.MessagePort = port })
+
+	sendAck(currHost)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, size)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == size {
+		t.Fatalf("ACK does not fit in %d bytes", size)
+	}
+	return buf[:n]
+}
+
+//An ACK sent to a group with an old member fits the old builds' buffer and decodes with their message
+func TestAckDecodesOnBaseline(t *testing.T) {
+	hosts := []int{2, 3, 4, 5, 6, 7, 8, 9}
+	setMembers(t, hosts...)
+	addOldMember(t, 10)
+	learnCoordinates(hosts...)
+
+	data := receiveAck(t, BASELINE_BUFFER_SIZE)
+	var msg baselineMessage
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+		t.Fatalf("baseline cannot decode the ACK: %v", err)
+	}
+	if msg.Host != currHost || msg.Status != "ACK" {
+		t.Fatalf("baseline decoded %+v", msg)
+	}
+}
+
+//Once every member runs this build ACK's carry the coordinates again
+func TestAckCarriesCoordinatesAtVersion2(t *testing.T) {
+	hosts := []int{2, 3, 4, 5, 6, 7, 8, 9}
+	setMembers(t, hosts...)
+	learnCoordinates(hosts...)
+
+	var msg message
+	if err := gob.NewDecoder(bytes.NewReader(receiveAck(t, MAX_PACKET_SIZE))).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Coords) < len(hosts) {
+		t.Fatalf("ACK carries %d coordinates, want at least %d", len(msg.Coords), len(hosts))
+	}
+}
+
+//A membership list for a group with an old member fits the old builds' buffer and decodes as their []member
+func TestListDecodesOnBaseline(t *testing.T) {
+	for _, size := range []int{2, 5, 8} {
+		list := []member{oldMember(1)}
+		for i := 2; i <= size; i++ {
+			m := testMember(i, 3)
+			m.Tags = map[string]string{"zone": "a", "rack": "r1"}
+			list = append(list, m)
+		}
+		data, err := encodeList(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) >= BASELINE_BUFFER_SIZE {
+			t.Fatalf("list of %d members is %d bytes", size, len(data))
+		}
+		buf := make([]byte, BASELINE_BUFFER_SIZE)
+		n := copy(buf, data)
+		var members []baselineMember
+		if err := gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&members); err != nil {
+			t.Fatalf("baseline cannot decode a list of %d members: %v", size, err)
+		}
+		if len(members) != size || members[1].Host != testHost(2) {
+			t.Fatalf("baseline decoded %v", members)
+		}
+	}
+}
+
+//Failed messages from old builds carry no incarnation and still remove the member
+func TestFailedWithoutIncarnation(t *testing.T) {
+	setMembers(t, 2, 3)
+	addOldMember(t, 4)
+	updateState(func(s *groupState) bool {
+		return addMember(s, testMember(2, 5))
+	})
+
+	msg := message{Host: testHost(2), Status: "Failed", TimeStamp: time.Now().Format(time.RFC850), Reporter: testHost(4)}
+	propagateMsg(msg)
+	if snapshot().contains(testHost(2)) {
+		t.Fatalf("Failed without incarnation ignored")
+	}
+
+	msg = newMsg(testHost(3), "Failed")
+	msg.Incarnation = 0
+	updateState(func(s *groupState) bool {
+		return addMember(s, testMember(3, 7))
+	})
+	msg.Incarnation = 6
+	propagateMsg(msg)
+	if !snapshot().contains(testHost(3)) {
+		t.Fatalf("Failed about an older incarnation applied")
+	}
+}
+
+//A group with a cluster_name sends version 1 lists once one member only speaks version 1, and its members
+//must still take them
+func TestVersion1ListInNamedCluster(t *testing.T) {
+	old := conf().ClusterName
+	setConfig(func(c *config) { c.ClusterName = "staging" })
+	t.Cleanup(func() { setConfig(func(c *config) { c.ClusterName = old }) })
+
+	list := []member{testMember(1, 1), testMember(2, 1), testMember(3, 1)}
+	list[2].MaxVersion = 1
+	data, err := encodeList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mL, err := decodeList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mL.Version != 1 || len(mL.Members) != 3 {
+		t.Fatalf("decoded %+v, want a version 1 list of 3 members", mL)
+	}
+	if !fromOurCluster(mL.Cluster, "MembershipList", "", net.IPv4(127, 0, 0, 3)) {
+		t.Fatalf("version 1 list labelled cluster %q was dropped", mL.Cluster)
+	}
+}
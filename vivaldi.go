@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Number of dimensions in the Euclidean part of a Vivaldi coordinate
+const VIVALDI_DIMENSIONS = 8
+
+//Largest error estimate a coordinate can carry. New coordinates start here
+const VIVALDI_ERROR_MAX = 1.5
+
+//Tuning constants from the Vivaldi paper. CE controls how quickly the error estimate
+//adapts and CC controls how far a single sample moves the coordinate
+const VIVALDI_CE = 0.25
+const VIVALDI_CC = 0.25
+
+//Smallest height (in seconds) a coordinate may have
+const VIVALDI_HEIGHT_MIN = 10.0e-6
+
+//RTT samples above this are treated as bogus and ignored
+const VIVALDI_MAX_RTT = 10 * time.Second
+
+//Values below this are treated as 0 to avoid dividing by tiny numbers
+const vivaldiZero = 1.0e-6
+
+var errInvalidCoordinate = errors.New("vivaldi update produced an invalid coordinate, resetting")
+
+//A Vivaldi network coordinate. Vec and Height are in seconds, so the distance
+//between two coordinates is an estimate of the RTT between the two VM's
+type coordinate struct {
+	Vec    []float64
+	Height float64
+	Error  float64
+	//Time the owner of the coordinate last updated it (Unix nanoseconds on the owner's clock). Only
+	//compared with other versions of the same VM's coordinate, so clocks need not agree
+	Updated int64
+}
+
+//Coordinate of the local VM, updated every time an ACK comes back for one of our SYN's
+var localCoord = newCoordinate()
+
+//Last known coordinate of every other member, learned from SYN's and ACK's. Entries of VM's that are no
+//longer in the membershipList are dropped every probe_interval
+var coordCache = make(map[string]coordinate)
+
+//Time each outstanding SYN was sent, keyed by target host. Used to measure RTT when the ACK arrives
+var synTimes = make(map[string]time.Time)
+
+//Mutex used for localCoord, coordCache and synTimes
+var coordMutex = &sync.Mutex{}
+
+//Returns a coordinate at the origin with the maximum error
+func newCoordinate() coordinate {
+	return coordinate{make([]float64, VIVALDI_DIMENSIONS), VIVALDI_HEIGHT_MIN, VIVALDI_ERROR_MAX, time.Now().UnixNano()}
+}
+
+//Returns a deep copy of the coordinate so it can be handed to other goroutines
+func (c coordinate) clone() coordinate {
+	vec := make([]float64, len(c.Vec))
+	copy(vec, c.Vec)
+	return coordinate{vec, c.Height, c.Error, c.Updated}
+}
+
+//A coordinate is only usable if it has the expected number of dimensions and no NaN's
+func (c coordinate) isValid() bool {
+	if len(c.Vec) != VIVALDI_DIMENSIONS {
+		return false
+	}
+	for _, v := range c.Vec {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return !math.IsNaN(c.Height) && !math.IsNaN(c.Error)
+}
+
+//Estimated RTT between two coordinates
+func (c coordinate) distanceTo(other coordinate) time.Duration {
+	dist := magnitude(diff(c.Vec, other.Vec)) + c.Height + other.Height
+	return time.Duration(dist * float64(time.Second))
+}
+
+//Moves the coordinate by force seconds along the line between other and c. A positive
+//force pushes c away from other and a negative force pulls it closer
+func (c coordinate) applyForce(force float64, other coordinate) coordinate {
+	unit, mag := unitVectorAt(c.Vec, other.Vec)
+	ret := c.clone()
+	for i := range ret.Vec {
+		ret.Vec[i] += unit[i] * force
+	}
+	if mag > vivaldiZero {
+		ret.Height = (ret.Height+other.Height)*force/mag + ret.Height
+		ret.Height = math.Max(ret.Height, VIVALDI_HEIGHT_MIN)
+	}
+	return ret
+}
+
+//Returns a - b
+func diff(a, b []float64) []float64 {
+	ret := make([]float64, len(a))
+	for i := range a {
+		ret[i] = a[i] - b[i]
+	}
+	return ret
+}
+
+//Returns the euclidean length of v
+func magnitude(v []float64) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+//Returns the unit vector pointing from b to a and the distance between them. If the two
+//points are on top of each other a random direction is picked so they can be pulled apart
+func unitVectorAt(a, b []float64) ([]float64, float64) {
+	ret := diff(a, b)
+	if mag := magnitude(ret); mag > vivaldiZero {
+		for i := range ret {
+			ret[i] /= mag
+		}
+		return ret, mag
+	}
+	for i := range ret {
+		ret[i] = rand.Float64() - 0.5
+	}
+	if mag := magnitude(ret); mag > vivaldiZero {
+		for i := range ret {
+			ret[i] /= mag
+		}
+		return ret, 0.0
+	}
+	//Picked a zero vector, just push along the first axis
+	ret = make([]float64, len(a))
+	ret[0] = 1.0
+	return ret, 0.0
+}
+
+//Called when a SYN is sent to host so the RTT can be measured when the ACK comes back
+func recordSyn(host string) {
+	coordMutex.Lock()
+	synTimes[host] = time.Now()
+	coordMutex.Unlock()
+}
+
+//Called when an ACK is received. Stores the sender's coordinate and, if we have an outstanding
+//SYN to the sender, feeds the measured RTT into the local coordinate
+func recordAck(host string, remote coordinate) {
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+
+	if !remote.isValid() {
+		return
+	}
+	if snapshot().contains(host) {
+		coordCache[host] = remote.clone()
+	}
+
+	sent, ok := synTimes[host]
+	if !ok {
+		return
+	}
+	delete(synTimes, host)
+	rtt := time.Since(sent)
+	probeRTT.observe(rtt.Seconds())
+	probeLog.Debug("ACK received", peerAttr(host), latencyAttr(rtt))
+	if rtt <= 0 || rtt > VIVALDI_MAX_RTT {
+		return
+	}
+	updateCoordinate(remote, rtt)
+}
+
+//Stores coordinates learned from a neighbour so estimates can be made between any two members. A
+//coordinate replaces the cached one if its owner updated it more recently, whatever their errors, so a
+//member whose network changed is not stuck with the estimate from before the change. Coordinates of
+//VM's that are not in the membershipList are ignored
+func mergeCoordinates(coords map[string]coordinate) {
+	s := snapshot()
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+	for host, c := range coords {
+		if host == currHost || !c.isValid() || !s.contains(host) {
+			continue
+		}
+		if old, ok := coordCache[host]; ok && old.Updated >= c.Updated {
+			continue
+		}
+		coordCache[host] = c.clone()
+	}
+}
+
+//Drops the coordinates and outstanding SYN's of VM's that are no longer in the membershipList
+func pruneCoordinates() {
+	s := snapshot()
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+	for host := range coordCache {
+		if !s.contains(host) {
+			delete(coordCache, host)
+		}
+	}
+	for host := range synTimes {
+		if !s.contains(host) {
+			delete(synTimes, host)
+		}
+	}
+}
+
+//Vivaldi update step. Must be called while holding coordMutex
+func updateCoordinate(remote coordinate, rtt time.Duration) {
+	rttSeconds := math.Max(rtt.Seconds(), vivaldiZero)
+	dist := localCoord.distanceTo(remote).Seconds()
+	wrongness := math.Abs(dist-rttSeconds) / rttSeconds
+
+	totalError := math.Max(localCoord.Error+remote.Error, vivaldiZero)
+	weight := localCoord.Error / totalError
+
+	localCoord.Error = VIVALDI_CE*weight*wrongness + localCoord.Error*(1.0-VIVALDI_CE*weight)
+	if localCoord.Error > VIVALDI_ERROR_MAX {
+		localCoord.Error = VIVALDI_ERROR_MAX
+	}
+
+	force := VIVALDI_CC * weight * (rttSeconds - dist)
+	updated := localCoord.applyForce(force, remote)
+	if updated.isValid() {
+		localCoord = updated
+		localCoord.Updated = time.Now().UnixNano()
+	} else {
+		errorCheck(errInvalidCoordinate)
+		localCoord = newCoordinate()
+	}
+}
+
+//Returns a copy of the local coordinate
+func getLocalCoord() coordinate {
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+	return localCoord.clone()
+}
+
+//Returns a copy of every known coordinate, including our own
+func getCoordinates() map[string]coordinate {
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+	coords := make(map[string]coordinate, len(coordCache)+1)
+	for host, c := range coordCache {
+		coords[host] = c.clone()
+	}
+	coords[currHost] = localCoord.clone()
+	return coords
+}
+
+//Returns the coordinates sent on ACK's: our own and the ones we know for members of the membershipList,
+//so the size of an ACK grows with the group and not with every VM ever seen
+func gossipCoordinates() map[string]coordinate {
+	members := snapshot().Members
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+	coords := make(map[string]coordinate, len(members))
+	for _, element := range members {
+		if c, ok := coordCache[element.Host]; ok {
+			coords[element.Host] = c.clone()
+		}
+	}
+	coords[currHost] = localCoord.clone()
+	return coords
+}
+
+//Estimates the RTT between two members. Returns false if the coordinate of either is unknown
+func estimateRTT(a, b string) (time.Duration, bool) {
+	coords := getCoordinates()
+	ca, okA := coords[a]
+	cb, okB := coords[b]
+	if !okA || !okB {
+		return 0, false
+	}
+	return ca.distanceTo(cb), true
+}
+
+//Returns up to n members of the group sorted by estimated RTT to host, closest first.
+//Members without a known coordinate are left out
+func nearestMembers(host string, n int) []string {
+	coords := getCoordinates()
+	origin, ok := coords[host]
+	if !ok {
+		return nil
+	}
+
+	members := snapshot().Members
+	hosts := make([]string, 0, len(members))
+	for _, element := range members {
+		if _, ok := coords[element.Host]; ok && element.Host != host {
+			hosts = append(hosts, element.Host)
+		}
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return origin.distanceTo(coords[hosts[i]]) < origin.distanceTo(coords[hosts[j]])
+	})
+	if n >= 0 && len(hosts) > n {
+		hosts = hosts[:n]
+	}
+	return hosts
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//Returns a valid coordinate with the given error, updated by its owner at updated
+func testCoordinate(x float64, err float64, updated int64) coordinate {
+	c := newCoordinate()
+	c.Vec[0] = x
+	c.Error = err
+	c.Updated = updated
+	return c
+}
+
+//Forgets every learned coordinate
+func clearCoordinates() {
+	coordMutex.Lock()
+	coordCache = make(map[string]coordinate)
+	synTimes = make(map[string]time.Time)
+	coordMutex.Unlock()
+}
+
+//A coordinate its owner updated more recently replaces the cached one even if it has a higher error
+func TestMergeCoordinatesPrefersFresher(t *testing.T) {
+	setMembers(t, 2)
+	clearCoordinates()
+	host := testHost(2)
+
+	mergeCoordinates(map[string]coordinate{host: testCoordinate(0.001, 0.1, 100)})
+	mergeCoordinates(map[string]coordinate{host: testCoordinate(0.002, 0.9, 200)})
+	if c := getCoordinates()[host]; c.Updated != 200 {
+		t.Fatalf("fresher coordinate with a higher error not taken: %+v", c)
+	}
+	mergeCoordinates(map[string]coordinate{host: testCoordinate(0.003, 0.01, 150)})
+	if c := getCoordinates()[host]; c.Updated != 200 {
+		t.Fatalf("older coordinate with a lower error replaced a fresher one: %+v", c)
+	}
+}
+
+//Only members of the membershipList are cached and gossiped, and departed members are pruned
+func TestCoordinatesOfLiveMembersOnly(t *testing.T) {
+	setMembers(t, 2, 3)
+	clearCoordinates()
+	mergeCoordinates(map[string]coordinate{
+		testHost(2): testCoordinate(0.001, 0.5, 1),
+		testHost(3): testCoordinate(0.002, 0.5, 1),
+		testHost(9): testCoordinate(0.003, 0.5, 1),
+	})
+	if _, ok := getCoordinates()[testHost(9)]; ok {
+		t.Fatalf("coordinate of a VM that is not a member cached")
+	}
+
+	msg := newMsg(testHost(3), "Failed")
+	msg.Incarnation = 1
+	propagateMsg(msg)
+	if _, ok := gossipCoordinates()[testHost(3)]; ok {
+		t.Fatalf("coordinate of a failed member gossiped")
+	}
+	pruneCoordinates()
+	coords := getCoordinates()
+	if _, ok := coords[testHost(3)]; ok {
+		t.Fatalf("coordinate of a failed member not pruned")
+	}
+	if _, ok := coords[testHost(2)]; !ok || len(coords) != 2 {
+		t.Fatalf("coordinates after pruning = %v", coords)
+	}
+}
+
+//The members nearest to a VM are sorted by estimated RTT
+func TestNearest(t *testing.T) {
+	setMembers(t, 2, 3, 4)
+	clearCoordinates()
+	mergeCoordinates(map[string]coordinate{
+		testHost(2): testCoordinate(0.030, 0.5, 1),
+		testHost(3): testCoordinate(0.010, 0.5, 1),
+		testHost(4): testCoordinate(0.020, 0.5, 1),
+	})
+
+	nearest, err := getNearest(testHost(2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 2 || nearest[0].To != testHost(4) || nearest[1].To != testHost(3) {
+		t.Fatalf("nearest to %s = %v", testHost(2), nearest)
+	}
+	if _, err := getRTT(testHost(9), ""); err != errNoCoordinate {
+		t.Fatalf("getRTT of an unknown host = %v", err)
+	}
+}